@@ -2,8 +2,14 @@ package main
 
 import (
 	"errors"
+	backup "github.com/IRT-SystemX/bcm-poller/internal/backup"
+	tracking "github.com/IRT-SystemX/bcm-poller/internal/metrics"
 	eth "github.com/IRT-SystemX/bcm-poller/internal/metrics/eth"
 	hlf "github.com/IRT-SystemX/bcm-poller/internal/metrics/hlf"
+	sink "github.com/IRT-SystemX/bcm-poller/internal/sink"
+	store "github.com/IRT-SystemX/bcm-poller/internal/store"
+	stream "github.com/IRT-SystemX/bcm-poller/internal/stream"
+	webhook "github.com/IRT-SystemX/bcm-poller/internal/webhook"
 	model "github.com/IRT-SystemX/bcm-poller/poller"
 	poller "github.com/IRT-SystemX/bcm-poller/poller/engine"
 	utils "github.com/IRT-SystemX/bcm-poller/utils"
@@ -12,8 +18,13 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"log"
+	"math/big"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const (
@@ -22,57 +33,299 @@ const (
 )
 
 var (
-	ethUrl          string = "ws://localhost:8546"
-	hlfPath         string = "/tmp/hyperledger-fabric-network/settings/connection-org1.json"
-	walletUser      string = "admin"
-	orgUser         string = "Admin"
-	port            int    = 8000
-	config          string = "config.yml"
-	restore         bool   = false
-	backupPath      string = "backup.json"
-	backupFrequency int    = 0
-	start           string = "0"
-	end             string = "-1"
-	syncMode        string = "normal"
-	syncThreadPool  int    = 4
-	syncThreadSize  int    = 25
-	ledgerPath      string = "/chain"
-	apiUrl          string = "http://localhost:8545"
-	metrics         bool   = false
+	ethUrl          string        = "ws://localhost:8546"
+	hlfPath         string        = "/tmp/hyperledger-fabric-network/settings/connection-org1.json"
+	walletUser      string        = "admin"
+	orgUser         string        = "Admin"
+	port            int           = 8000
+	config          string        = "config.yml"
+	restore         bool          = false
+	backupPath      string        = "backup.json"
+	backupFrequency int           = 0
+	start           string        = "0"
+	end             string        = "-1"
+	syncMode        string        = "normal"
+	syncThreadPool  int           = 4
+	syncThreadSize  int           = 25
+	ledgerPath      string        = "/chain"
+	apiUrl          string        = "http://localhost:8545"
+	metrics         bool          = false
+	storePath       string        = ""
+	adminToken      string        = ""
+	outboxPath      string        = "outbox.json"
+	webhookLive     bool          = false
+	deadLetterPath  string        = "deadletters.json"
+	queueSize       int           = 10000
+	sinkOverflow    string        = "block"
+	sinkUrl         string        = ""
+	confirmations   int           = 0
+	generations     int           = 3
+	backupInterval  time.Duration = 0
+	finalized       bool          = false
+	listenMode      string        = "auto"
+	pollInterval    time.Duration = 5 * time.Second
+	healthInterval  time.Duration = 10 * time.Second
+	roundRobin      bool          = false
+	quorum          int           = 0
 )
 
 func runEth(cmd *cobra.Command, args []string) {
 	engine := poller.NewEthEngine(viper.GetString("url"), viper.GetString("syncMode"), viper.GetInt("syncThreadPool"), viper.GetInt("syncThreadSize"))
 
 	log.Printf("Poller is connecting to " + viper.GetString("url"))
-	client := interface{}(engine.RawEngine).(*poller.EthEngine).Connect()
+	node := interface{}(engine.RawEngine).(*poller.EthEngine)
+	node.Connect()
 	log.Printf("Poller is connected to  " + viper.GetString("url"))
 
-	cache := eth.NewExporterCache(client, utils.NewFetcher(viper.GetString("api")), viper.GetString("config"), viper.GetString("backupPath"), viper.GetBool("restore"), int64(viper.GetInt("backup")))
-	fork := eth.NewForkWatcher(interface{}(cache).(model.Connector), maxForkSize)
-	processor := eth.NewProcessor(client, fork)
+	cache, err := eth.NewExporterCache(node, utils.NewFetcher(viper.GetString("api")), viper.GetString("config"), viper.GetString("backupPath"), viper.GetBool("restore"), int64(viper.GetInt("backup")))
+	if err != nil {
+		log.Fatal(err)
+	}
+	restoreBackup(engine, cache.RawCache)
+	handlers := make(map[string]http.Handler)
+	backups(cache.RawCache, handlers)
+	hub := stream.NewHub()
+	cache.AddObserver(hub)
+	handlers["/stream"] = hub
+	if dispatcher := openWebhooks(viper.GetString("config"), viper.GetString("outboxPath"), cache.RawCache); dispatcher != nil {
+		defer dispatcher.Close()
+		cache.AddObserver(dispatcher)
+	}
+	st := openStore(viper.GetString("storePath"))
+	if st != nil {
+		defer st.Close()
+		cache.AddObserver(st)
+		handlers["/events/"] = st
+	}
+	engine.SetQueueSize(viper.GetInt("queueSize"))
+	engine.AddConnector("cache", interface{}(cache).(model.Connector))
+	deadLetters(engine)
+	openSink(viper.GetString("sink"), "eth", engine, handlers)
+	fork := eth.NewForkWatcher(engine, viper.GetInt("maxForkSize"))
+	fork.SetRecorder(cache.Cache)
+	processor, err := eth.NewProcessor(node, fork)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	initEngine(viper.GetString("start"), cache.Stats["block"].Count, viper.GetString("end"), engine, interface{}(cache).(model.Connector), interface{}(processor).(model.Processor))
+	initEngine(viper.GetString("start"), resume(cache.RawCache), viper.GetString("end"), engine, interface{}(processor).(model.Processor))
+	engine.SetCheckDepth(viper.GetInt("maxForkSize"))
+	listen(engine, cache.RawCache)
+	failover(node)
+	confirm(engine, cache.RawCache)
+	if st != nil {
+		// the blocks recorded before the start were only counted if restored
+		floor := engine.Start()
+		if viper.GetBool("restore") {
+			floor = big.NewInt(0)
+		}
+		fork.SetHistory(st, floor)
+	}
 
-	run(viper.GetString("port"), viper.GetString("ledgerPath"), engine, interface{}(cache).(model.Connector), map[string]interface{}{"stats": cache.Stats, "tracking": cache.Tracking, "status": engine.Status()})
+	manage(cache, engine, handlers)
+
+	run(viper.GetString("port"), viper.GetString("ledgerPath"), engine, interface{}(cache).(model.Connector), cache.RLocker(), map[string]interface{}{"stats": cache.Stats, "tracking": cache.Tracking, "forks": cache.Forks, "status": engine.Status()}, handlers)
+	shutdown(cache.RawCache)
 }
 
 func runHlf(cmd *cobra.Command, args []string) {
 	engine := poller.NewHlfEngine(viper.GetString("path"), viper.GetString("walletUser"), viper.GetString("orgUser"), viper.GetString("syncMode"), viper.GetInt("syncThreadPool"), viper.GetInt("syncThreadSize"))
 
 	log.Printf("Poller is connecting")
-	interface{}(engine.RawEngine).(*poller.HlfEngine).Connect()
+	if err := interface{}(engine.RawEngine).(*poller.HlfEngine).Connect(); err != nil {
+		log.Fatal(err)
+	}
 	log.Printf("Poller is connected")
 
-	cache := hlf.NewCache(viper.GetString("config"), viper.GetString("backupPath"), viper.GetBool("restore"), int64(viper.GetInt("backup")))
+	cache, err := hlf.NewCache(viper.GetString("config"), viper.GetString("backupPath"), viper.GetBool("restore"), int64(viper.GetInt("backup")))
+	if err != nil {
+		log.Fatal(err)
+	}
+	restoreBackup(engine, cache.RawCache)
 	processor := hlf.NewProcessor()
 
-	initEngine(viper.GetString("start"), cache.Stats["block"].Count, viper.GetString("end"), engine, interface{}(cache).(model.Connector), interface{}(processor).(model.Processor))
+	handlers := make(map[string]http.Handler)
+	backups(cache.RawCache, handlers)
+	hub := stream.NewHub()
+	cache.AddObserver(hub)
+	handlers["/stream"] = hub
+	if dispatcher := openWebhooks(viper.GetString("config"), viper.GetString("outboxPath"), cache.RawCache); dispatcher != nil {
+		defer dispatcher.Close()
+		cache.AddObserver(dispatcher)
+	}
+	if st := openStore(viper.GetString("storePath")); st != nil {
+		defer st.Close()
+		cache.AddObserver(st)
+		handlers["/events/"] = st
+	}
+	engine.SetQueueSize(viper.GetInt("queueSize"))
+	engine.AddConnector("cache", interface{}(cache).(model.Connector))
+	deadLetters(engine)
+	openSink(viper.GetString("sink"), "hlf", engine, handlers)
+
+	initEngine(viper.GetString("start"), resume(cache.RawCache), viper.GetString("end"), engine, interface{}(processor).(model.Processor))
+	engine.SetCheckDepth(maxForkSize)
+	confirm(engine, cache.RawCache)
+
+	manage(cache, engine, handlers)
+
+	run(viper.GetString("port"), viper.GetString("ledgerPath"), engine, interface{}(cache).(model.Connector), cache.RLocker(), map[string]interface{}{"stats": cache.Stats, "tracking": cache.Tracking, "status": engine.Status()}, handlers)
+	shutdown(cache.RawCache)
+}
+
+func backfillEth(cmd *cobra.Command, args []string) {
+	engine := poller.NewEthEngine(viper.GetString("url"), viper.GetString("syncMode"), viper.GetInt("syncThreadPool"), viper.GetInt("syncThreadSize"))
+
+	log.Printf("Poller is connecting to " + viper.GetString("url"))
+	node := interface{}(engine.RawEngine).(*poller.EthEngine)
+	node.Connect()
+	log.Printf("Poller is connected to  " + viper.GetString("url"))
+
+	cache, err := eth.NewCache(node, viper.GetString("config"), viper.GetString("backupPath"), hasBackup(viper.GetString("backupPath")), 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	processor, err := eth.NewProcessor(node, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	engine.SetProcessor(processor)
+	cache.SetOrigin(cache.Origin())
+
+	backfill(cmd, cache, engine)
+	if err = cache.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func backfillHlf(cmd *cobra.Command, args []string) {
+	engine := poller.NewHlfEngine(viper.GetString("path"), viper.GetString("walletUser"), viper.GetString("orgUser"), viper.GetString("syncMode"), viper.GetInt("syncThreadPool"), viper.GetInt("syncThreadSize"))
+
+	log.Printf("Poller is connecting")
+	if err := interface{}(engine.RawEngine).(*poller.HlfEngine).Connect(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Poller is connected")
+
+	cache, err := hlf.NewCache(viper.GetString("config"), viper.GetString("backupPath"), hasBackup(viper.GetString("backupPath")), 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	engine.SetProcessor(hlf.NewProcessor())
+	cache.SetOrigin(cache.Origin())
+
+	backfill(cmd, cache, engine)
+	if err = cache.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func reprocessEth(cmd *cobra.Command, args []string) {
+	engine := poller.NewEthEngine(viper.GetString("url"), viper.GetString("syncMode"), viper.GetInt("syncThreadPool"), viper.GetInt("syncThreadSize"))
+
+	log.Printf("Poller is connecting to " + viper.GetString("url"))
+	node := interface{}(engine.RawEngine).(*poller.EthEngine)
+	node.Connect()
+	log.Printf("Poller is connected to  " + viper.GetString("url"))
+
+	cache, err := eth.NewCache(node, viper.GetString("config"), viper.GetString("backupPath"), hasBackup(viper.GetString("backupPath")), 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	processor, err := eth.NewProcessor(node, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	engine.SetProcessor(processor)
+
+	reprocess(cache, engine)
+	if err = cache.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func reprocessHlf(cmd *cobra.Command, args []string) {
+	engine := poller.NewHlfEngine(viper.GetString("path"), viper.GetString("walletUser"), viper.GetString("orgUser"), viper.GetString("syncMode"), viper.GetInt("syncThreadPool"), viper.GetInt("syncThreadSize"))
+
+	log.Printf("Poller is connecting")
+	if err := interface{}(engine.RawEngine).(*poller.HlfEngine).Connect(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Poller is connected")
+
+	cache, err := hlf.NewCache(viper.GetString("config"), viper.GetString("backupPath"), hasBackup(viper.GetString("backupPath")), 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	engine.SetProcessor(hlf.NewProcessor())
+
+	reprocess(cache, engine)
+	if err = cache.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func hasBackup(path string) bool {
+	store, name, err := backup.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = store.Read(name)
+	return err == nil
+}
+
+// backfill replays the range of blocks between --start and --end for the labels into the backup
+func backfill(cmd *cobra.Command, manager tracking.Manager, engine *model.Engine) {
+	labels, _ := cmd.Flags().GetStringSlice("labels")
+	for _, label := range labels {
+		if !manager.Tracked(label) {
+			log.Fatal(errors.New("Unknown event " + label + " in " + viper.GetString("config")))
+		}
+	}
+	from, _ := new(big.Int).SetString(viper.GetString("start"), 10)
+	to, _ := new(big.Int).SetString(viper.GetString("end"), 10)
+	if to != nil && to.Sign() < 0 {
+		last, err := engine.Latest()
+		if err != nil {
+			log.Fatal(err)
+		}
+		to = last
+	}
+	job, err := tracking.NewBackfillJob(labels, from, to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	job.Run(manager, engine, &sync.Mutex{})
+}
 
-	run(viper.GetString("port"), viper.GetString("ledgerPath"), engine, interface{}(cache).(model.Connector), map[string]interface{}{"stats": cache.Stats, "tracking": cache.Tracking, "status": engine.Status()})
+// deadLetters keeps the blocks still failing after their retries in --deadLetterPath
+func deadLetters(engine *model.Engine) {
+	letters, err := model.NewDeadLetters(viper.GetString("deadLetterPath"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	engine.SetDeadLetters(letters)
 }
 
-func initEngine(start string, defaultStart string, end string, engine *model.Engine, cache model.Connector, processor model.Processor) {
+// reprocess applies the blocks of --deadLetterPath to the backup, the blocks still failing being kept
+func reprocess(cache model.Connector, engine *model.Engine) {
+	deadLetters(engine)
+	gaps := engine.Reprocess(func(blockEvent model.BlockEvent) {
+		cache.Apply(blockEvent)
+	})
+	log.Printf("Reprocess done, %d blocks still failing", len(gaps))
+}
+
+// resume returns the last block applied of the backup restored, the number of blocks counted being used for the
+// backups without it: the blocks dead lettered or held back for confirmations are not counted
+func resume(cache *tracking.RawCache) string {
+	if head := cache.Head(); len(head.Number) > 0 {
+		return head.Number
+	}
+	return cache.Stats["block"].Count
+}
+
+func initEngine(start string, defaultStart string, end string, engine *model.Engine, processor model.Processor) {
 	if start == "-1" {
 		if viper.GetBool("restore") {
 			engine.SetStart(defaultStart, true)
@@ -87,21 +340,170 @@ func initEngine(start string, defaultStart string, end string, engine *model.Eng
 		engine.SetStart(start, false)
 	}
 	engine.SetEnd(end)
-	engine.SetConnector(cache)
 	engine.SetProcessor(processor)
 }
 
-func run(port string, ledgerPath string, engine *model.Engine, cache model.Connector, bind map[string]interface{}) {
-	disk := utils.NewDiskUsage(ledgerPath, refresh)
+// listen polls the nodes with --listenMode poll, or auto on the http urls, instead of subscribing to the new heads
+func listen(engine *model.Engine, cache *tracking.RawCache) {
+	if err := interface{}(engine.RawEngine).(*poller.EthEngine).SetListenMode(viper.GetString("listenMode"), viper.GetDuration("pollInterval"), cache); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// failover checks the health of the nodes of --url every --healthInterval, fetching the past blocks from them in turn
+// with --roundRobin and checking the new blocks against --quorum nodes
+func failover(node *poller.EthEngine) {
+	if interval := viper.GetDuration("healthInterval"); interval > 0 {
+		node.SetHealthCheck(interval)
+	}
+	node.SetRoundRobin(viper.GetBool("roundRobin"))
+	if quorum := viper.GetInt("quorum"); quorum != 0 {
+		if err := node.SetQuorum(quorum); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// restoreBackup keeps --backupGenerations backups and checks that the last block of the backup restored is still on the chain
+func restoreBackup(engine *model.Engine, cache *tracking.RawCache) {
+	cache.SetGenerations(viper.GetInt("backupGenerations"))
+	head := cache.Head()
+	if !viper.GetBool("restore") || len(head.Hash) == 0 {
+		return
+	}
+	number, _ := new(big.Int).SetString(head.Number, 10)
+	hash, err := engine.RawEngine.(model.Hasher).Hash(number)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if hash != head.Hash {
+		log.Fatalf("Backup block #%s %s is not on the chain anymore (%s): restore an older generation of the backup or resync", head.Number, head.Hash, hash)
+	}
+	log.Printf("Backup block #%s %s is on the chain", head.Number, head.Hash)
+}
+
+// backups writes the backup every --backupInterval and on POST /backup
+func backups(cache *tracking.RawCache, handlers map[string]http.Handler) {
+	if interval := viper.GetDuration("backupInterval"); interval > 0 {
+		cache.StartBackups(interval)
+	}
+	handlers["/backup"] = tracking.NewBackupHandler(cache, viper.GetString("adminToken"))
+}
+
+// shutdown writes the backup once the server is stopped
+func shutdown(cache *tracking.RawCache) {
+	if len(viper.GetString("backupPath")) > 0 {
+		if err := cache.Checkpoint(); err != nil {
+			log.Println("Error backup: ", err)
+		}
+	}
+}
+
+// confirm holds the blocks back until --confirmations blocks deep or finalized, counting them as pending meanwhile
+func confirm(engine *model.Engine, cache *tracking.RawCache) {
+	confirmations := viper.GetInt("confirmations")
+	if confirmations > 0 || viper.GetBool("finalized") {
+		if err := engine.SetConfirmations(confirmations, viper.GetBool("finalized"), cache.Pending()); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// manage reloads the configuration on SIGHUP and exposes the admin API when a token is set
+func manage(manager tracking.Manager, engine *model.Engine, handlers map[string]http.Handler) {
+	manager.SetOrigin(engine.Start())
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := manager.Reload(); err != nil {
+				log.Println("Error reload: ", err)
+			}
+		}
+	}()
+	if token := viper.GetString("adminToken"); len(token) > 0 {
+		handlers["/admin/"] = tracking.NewAdmin(manager, engine, token)
+	}
+}
+
+func openWebhooks(config string, path string, cache *tracking.RawCache) *webhook.Dispatcher {
+	raw, err := tracking.ReadConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhooks, err := webhook.ParseWebhooks(raw)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+	dispatcher, err := webhook.NewDispatcher(webhooks, path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if viper.GetBool("webhookLive") {
+		dispatcher.SetLive(cache.Ready)
+	}
+	dispatcher.Start()
+	return dispatcher
+}
+
+// openSink publishes the blocks to the broker of the url in parallel of the cache
+func openSink(url string, chain string, engine *model.Engine, handlers map[string]http.Handler) {
+	if len(url) == 0 {
+		return
+	}
+	broker, err := sink.Open(url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if memory, ok := broker.(*sink.MemoryBroker); ok {
+		handlers["/sink"] = memory
+	}
+	if nats, ok := broker.(*sink.NatsBroker); ok {
+		engine.Status().Set("sink", nats)
+	}
+	log.Printf("Sink publishing to %s", url)
+	engine.AddConnector("sink", sink.NewConnector(broker, chain))
+	if err = engine.SetOverflow("sink", viper.GetString("sinkOverflow")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func openStore(path string) *store.Store {
+	if len(path) == 0 {
+		return nil
+	}
+	st, err := store.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return st
+}
+
+func run(port string, ledgerPath string, engine *model.Engine, cache model.Connector, lock sync.Locker, bind map[string]interface{}, handlers map[string]http.Handler) {
+	disk, err := utils.NewDiskUsage(ledgerPath, refresh)
+	if err != nil {
+		log.Fatal(err)
+	}
 	bind["disk"] = disk
 	go func() {
-		engine.Init()
+		if err := engine.Init(); err != nil {
+			log.Fatal(err)
+		}
 		cache.SetReady()
 		disk.Start()
-		engine.Listen()
+		if err := engine.Listen(); err != nil {
+			log.Fatal(err)
+		}
 	}()
 	server := utils.NewServer(port)
+	server.SetLock(lock)
 	server.Bind(bind)
+	for path, handler := range handlers {
+		server.Handle(path, handler)
+	}
 	if viper.GetBool("metrics") {
 		if interface{}(cache).(*eth.ExporterCache).Fetcher == nil {
 			log.Fatal(errors.New("Cannot connect to " + viper.GetString("api") + " for metrics"))
@@ -122,22 +524,62 @@ func main() {
 		Use: "eth",
 		Run: runEth,
 	}
-	ethCmd.Flags().String("url", ethUrl, "Url socket web3")
-	ethCmd.Flags().String("api", apiUrl, "Url http web3")
-	ethCmd.Flags().Bool("metrics", metrics, "Expose open metrics")
-	viper.BindPFlag("url", ethCmd.Flags().Lookup("url"))
-	viper.BindPFlag("api", ethCmd.Flags().Lookup("api"))
-	viper.BindPFlag("metrics", ethCmd.Flags().Lookup("metrics"))
+	ethCmd.PersistentFlags().String("url", ethUrl, "Url socket web3, or urls separated by commas to fail over")
+	ethCmd.PersistentFlags().String("api", apiUrl, "Url http web3, or urls separated by commas to fail over")
+	ethCmd.PersistentFlags().Bool("metrics", metrics, "Expose open metrics")
+	ethCmd.PersistentFlags().Int("maxForkSize", maxForkSize, "Nb of last blocks checked for reorgs, deeper reorgs walked back from the node")
+	ethCmd.PersistentFlags().Bool("finalized", finalized, "Count the blocks once finalized by the chain (post-merge)")
+	ethCmd.PersistentFlags().String("listenMode", listenMode, "Listen mode (subscribe, poll or auto: poll the nodes of an http url)")
+	ethCmd.PersistentFlags().Duration("pollInterval", pollInterval, "Poll interval until the block time is observed")
+	ethCmd.PersistentFlags().Duration("healthInterval", healthInterval, "Health check interval of the nodes of the urls (disabled if 0)")
+	ethCmd.PersistentFlags().Bool("roundRobin", roundRobin, "Sync the past blocks from the nodes of the urls in turn")
+	ethCmd.PersistentFlags().Int("quorum", quorum, "Nb of nodes giving the same hash before processing a new block (disabled if 0)")
+	viper.BindPFlag("url", ethCmd.PersistentFlags().Lookup("url"))
+	viper.BindPFlag("api", ethCmd.PersistentFlags().Lookup("api"))
+	viper.BindPFlag("metrics", ethCmd.PersistentFlags().Lookup("metrics"))
+	viper.BindPFlag("maxForkSize", ethCmd.PersistentFlags().Lookup("maxForkSize"))
+	viper.BindPFlag("finalized", ethCmd.PersistentFlags().Lookup("finalized"))
+	viper.BindPFlag("listenMode", ethCmd.PersistentFlags().Lookup("listenMode"))
+	viper.BindPFlag("pollInterval", ethCmd.PersistentFlags().Lookup("pollInterval"))
+	viper.BindPFlag("healthInterval", ethCmd.PersistentFlags().Lookup("healthInterval"))
+	viper.BindPFlag("roundRobin", ethCmd.PersistentFlags().Lookup("roundRobin"))
+	viper.BindPFlag("quorum", ethCmd.PersistentFlags().Lookup("quorum"))
+	var ethBackfillCmd = &cobra.Command{
+		Use:   "backfill",
+		Short: "Replay the blocks from start to end for the labels into the backup",
+		Run:   backfillEth,
+	}
+	ethBackfillCmd.Flags().StringSlice("labels", []string{}, "Labels of the events to backfill")
+	ethBackfillCmd.MarkFlagRequired("labels")
+	ethCmd.AddCommand(ethBackfillCmd)
+	ethCmd.AddCommand(&cobra.Command{
+		Use:   "reprocess",
+		Short: "Reprocess the blocks of the dead letters into the backup",
+		Run:   reprocessEth,
+	})
 	var hlfCmd = &cobra.Command{
 		Use: "hlf",
 		Run: runHlf,
 	}
-	hlfCmd.Flags().String("path", hlfPath, "Path hlf files")
-	hlfCmd.Flags().String("walletUser", walletUser, "Wallet user hlf")
-	hlfCmd.Flags().String("orgUser", orgUser, "Org user hlf")
-	viper.BindPFlag("path", hlfCmd.Flags().Lookup("path"))
-	viper.BindPFlag("walletUser", hlfCmd.Flags().Lookup("walletUser"))
-	viper.BindPFlag("orgUser", hlfCmd.Flags().Lookup("orgUser"))
+	hlfCmd.PersistentFlags().String("path", hlfPath, "Path hlf files")
+	hlfCmd.PersistentFlags().String("walletUser", walletUser, "Wallet user hlf")
+	hlfCmd.PersistentFlags().String("orgUser", orgUser, "Org user hlf")
+	viper.BindPFlag("path", hlfCmd.PersistentFlags().Lookup("path"))
+	viper.BindPFlag("walletUser", hlfCmd.PersistentFlags().Lookup("walletUser"))
+	viper.BindPFlag("orgUser", hlfCmd.PersistentFlags().Lookup("orgUser"))
+	var hlfBackfillCmd = &cobra.Command{
+		Use:   "backfill",
+		Short: "Replay the blocks from start to end for the labels into the backup",
+		Run:   backfillHlf,
+	}
+	hlfBackfillCmd.Flags().StringSlice("labels", []string{}, "Labels of the events to backfill")
+	hlfBackfillCmd.MarkFlagRequired("labels")
+	hlfCmd.AddCommand(hlfBackfillCmd)
+	hlfCmd.AddCommand(&cobra.Command{
+		Use:   "reprocess",
+		Short: "Reprocess the blocks of the dead letters into the backup",
+		Run:   reprocessHlf,
+	})
 	var rootCmd = &cobra.Command{
 		Short: "Event poller with RESTful API",
 	}
@@ -145,8 +587,10 @@ func main() {
 	rootCmd.AddCommand(hlfCmd)
 	rootCmd.PersistentFlags().Int("port", port, "Port to run server on")
 	rootCmd.PersistentFlags().String("config", config, "Config file")
-	rootCmd.PersistentFlags().String("backupPath", backupPath, "Backup file path")
+	rootCmd.PersistentFlags().String("backupPath", backupPath, "Backup path: file, s3://bucket/key or consul://host:port/key")
 	rootCmd.PersistentFlags().Int("backup", backupFrequency, "Backup frequency in number of blocks")
+	rootCmd.PersistentFlags().Int("backupGenerations", generations, "Nb of previous backups kept as backupPath.1, backupPath.2...")
+	rootCmd.PersistentFlags().Duration("backupInterval", backupInterval, "Backup interval (disabled if 0)")
 	rootCmd.PersistentFlags().String("syncMode", syncMode, "Sync mode (fast or normal)")
 	rootCmd.PersistentFlags().Int("syncThreadPool", syncThreadPool, "Nb of thread to sync")
 	rootCmd.PersistentFlags().Int("syncThreadSize", syncThreadSize, "Nb of blocks per thread per sync round")
@@ -154,10 +598,21 @@ func main() {
 	rootCmd.PersistentFlags().String("end", end, "Sync end block")
 	rootCmd.PersistentFlags().Bool("restore", restore, "Restore backup")
 	rootCmd.PersistentFlags().String("ledgerPath", ledgerPath, "Monitored ledger path on disk")
+	rootCmd.PersistentFlags().String("storePath", storePath, "Directory of the store of blocks and matched transactions (disabled if empty)")
+	rootCmd.PersistentFlags().String("adminToken", adminToken, "Bearer token of the admin API (disabled if empty)")
+	rootCmd.PersistentFlags().String("outboxPath", outboxPath, "File of the webhook deliveries not sent yet")
+	rootCmd.PersistentFlags().Bool("webhookLive", webhookLive, "Only post to the webhooks the events detected once synced")
+	rootCmd.PersistentFlags().String("deadLetterPath", deadLetterPath, "File of the blocks still failing after their retries")
+	rootCmd.PersistentFlags().String("sink", sinkUrl, "Publish the blocks, transactions and reverts to stdout, memory, file://path or nats://host:port (disabled if empty)")
+	rootCmd.PersistentFlags().String("sinkOverflow", sinkOverflow, "Blocks of the sink once its queue is full: block (wait for the sink) or drop")
+	rootCmd.PersistentFlags().Int("queueSize", queueSize, "Nb of blocks queued for each connector (cache, sink) before its overflow (unbounded if 0)")
+	rootCmd.PersistentFlags().Int("confirmations", confirmations, "Nb of blocks on top of a block before counting it (disabled if 0)")
 	viper.BindPFlag("port", rootCmd.PersistentFlags().Lookup("port"))
 	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
 	viper.BindPFlag("backupPath", rootCmd.PersistentFlags().Lookup("backupPath"))
 	viper.BindPFlag("backup", rootCmd.PersistentFlags().Lookup("backup"))
+	viper.BindPFlag("backupGenerations", rootCmd.PersistentFlags().Lookup("backupGenerations"))
+	viper.BindPFlag("backupInterval", rootCmd.PersistentFlags().Lookup("backupInterval"))
 	viper.BindPFlag("syncMode", rootCmd.PersistentFlags().Lookup("syncMode"))
 	viper.BindPFlag("syncThreadPool", rootCmd.PersistentFlags().Lookup("syncThreadPool"))
 	viper.BindPFlag("syncThreadSize", rootCmd.PersistentFlags().Lookup("syncThreadSize"))
@@ -165,6 +620,15 @@ func main() {
 	viper.BindPFlag("start", rootCmd.PersistentFlags().Lookup("start"))
 	viper.BindPFlag("end", rootCmd.PersistentFlags().Lookup("end"))
 	viper.BindPFlag("ledgerPath", rootCmd.PersistentFlags().Lookup("ledgerPath"))
+	viper.BindPFlag("storePath", rootCmd.PersistentFlags().Lookup("storePath"))
+	viper.BindPFlag("adminToken", rootCmd.PersistentFlags().Lookup("adminToken"))
+	viper.BindPFlag("outboxPath", rootCmd.PersistentFlags().Lookup("outboxPath"))
+	viper.BindPFlag("webhookLive", rootCmd.PersistentFlags().Lookup("webhookLive"))
+	viper.BindPFlag("deadLetterPath", rootCmd.PersistentFlags().Lookup("deadLetterPath"))
+	viper.BindPFlag("sink", rootCmd.PersistentFlags().Lookup("sink"))
+	viper.BindPFlag("sinkOverflow", rootCmd.PersistentFlags().Lookup("sinkOverflow"))
+	viper.BindPFlag("queueSize", rootCmd.PersistentFlags().Lookup("queueSize"))
+	viper.BindPFlag("confirmations", rootCmd.PersistentFlags().Lookup("confirmations"))
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
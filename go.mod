@@ -5,6 +5,7 @@ go 1.15
 require (
 	github.com/ethereum/go-ethereum v1.9.11
 	github.com/golang/protobuf v1.3.3
+	github.com/gorilla/websocket v1.4.1-0.20190629185528-ae1634f6a989
 	github.com/hyperledger/fabric v2.1.1+incompatible
 	github.com/hyperledger/fabric-config v0.0.9
 	github.com/hyperledger/fabric-sdk-go v1.0.0-beta3
@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// maxConsulValue is the size limit of a value in the key-value store of Consul
+var maxConsulValue = 512 * 1024
+
+// ConsulStore keeps the backups in the key-value store of Consul, with the token of CONSUL_HTTP_TOKEN
+type ConsulStore struct {
+	client *http.Client
+	url    string
+	token  string
+}
+
+func NewConsulStore(host string) *ConsulStore {
+	return &ConsulStore{client: &http.Client{Timeout: timeout}, url: "http://" + host + "/v1/kv/", token: os.Getenv("CONSUL_HTTP_TOKEN")}
+}
+
+func (store *ConsulStore) do(method string, name string, payload []byte) ([]byte, error) {
+	target := store.url + name
+	if method == "GET" {
+		target += "?raw"
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if len(store.token) > 0 {
+		req.Header.Set("X-Consul-Token", store.token)
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && method == "GET" {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("consul %s %s: %s %s", method, name, resp.Status, string(body))
+	}
+	return body, nil
+}
+
+func (store *ConsulStore) Read(name string) ([]byte, error) {
+	return store.do("GET", name, nil)
+}
+
+// Write puts the value, replaced at once by Consul, refusing a value over its size limit
+func (store *ConsulStore) Write(name string, data []byte) error {
+	if len(data) > maxConsulValue {
+		return fmt.Errorf("consul PUT %s: %d bytes over the limit of %d bytes of a value", name, len(data), maxConsulValue)
+	}
+	_, err := store.do("PUT", name, data)
+	return err
+}
+
+func (store *ConsulStore) Delete(name string) error {
+	_, err := store.do("DELETE", name, nil)
+	return err
+}
@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeConsul stands in for the key-value store of Consul, refusing the requests without the token of the test
+type fakeConsul struct {
+	mux    sync.Mutex
+	values map[string][]byte
+}
+
+func (consul *fakeConsul) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	consul.mux.Lock()
+	defer consul.mux.Unlock()
+	if req.Header.Get("X-Consul-Token") != "TOKEN" {
+		http.Error(resp, "ACL not found", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(req.URL.Path, "/v1/kv/")
+	switch req.Method {
+	case "GET":
+		value, ok := consul.values[key]
+		if !ok || req.URL.RawQuery != "raw" {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp.Write(value)
+	case "PUT":
+		body, _ := ioutil.ReadAll(req.Body)
+		if len(body) > 512*1024 {
+			http.Error(resp, "Value exceeds 524288 byte limit", http.StatusRequestEntityTooLarge)
+			return
+		}
+		consul.values[key] = body
+		resp.Write([]byte("true"))
+	case "DELETE":
+		delete(consul.values, key)
+		resp.Write([]byte("true"))
+	}
+}
+
+func TestConsulStore(t *testing.T) {
+	consul := &fakeConsul{values: make(map[string][]byte)}
+	server := httptest.NewServer(consul)
+	defer server.Close()
+	store := NewConsulStore(strings.TrimPrefix(server.URL, "http://"))
+	store.token = "TOKEN"
+
+	for _, data := range []string{"1", "2", "3"} {
+		if err := Rotate(store, "poller/backup.json", []byte(data), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string]string{"poller/backup.json": "3", "poller/backup.json.1": "2"}
+	if len(consul.values) != len(expected) {
+		t.Errorf("got %d values, want %d", len(consul.values), len(expected))
+	}
+	for key, data := range expected {
+		if read, err := store.Read(key); err != nil || string(read) != data {
+			t.Errorf("%s: got %s, %v, want %s", key, read, err, data)
+		}
+	}
+	if err := store.Delete("poller/backup.json.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Read("poller/backup.json.1"); err != ErrNotFound {
+		t.Errorf("read after delete: got %v, want ErrNotFound", err)
+	}
+
+	if err := store.Write("poller/backup.json", make([]byte, maxConsulValue+1)); err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("write over the limit: got %v, want a limit error", err)
+	}
+	if string(consul.values["poller/backup.json"]) != "3" {
+		t.Errorf("value replaced by a write over the limit: got %d bytes", len(consul.values["poller/backup.json"]))
+	}
+
+	store.token = "OTHER"
+	if _, err := store.Read("poller/backup.json"); err == nil || err == ErrNotFound || !strings.Contains(err.Error(), "403") {
+		t.Errorf("read refused: got %v, want a 403 error", err)
+	}
+}
@@ -0,0 +1,147 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegion = "us-east-1"
+	timeout       = 30 * time.Second
+)
+
+// S3Store keeps the backups in a bucket of an S3 compatible object storage, addressed by path, the credentials being
+// read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+type S3Store struct {
+	client       *http.Client
+	endpoint     string
+	bucket       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func NewS3Store(bucket string, endpoint string, region string) (*S3Store, error) {
+	if len(region) == 0 {
+		region = defaultRegion
+	}
+	if len(endpoint) == 0 {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	store := &S3Store{
+		client:       &http.Client{Timeout: timeout},
+		endpoint:     strings.TrimSuffix(endpoint, "/"),
+		bucket:       bucket,
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if len(store.accessKey) == 0 || len(store.secretKey) == 0 {
+		return nil, errors.New("Missing AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY for s3://" + bucket)
+	}
+	return store, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashSHA256(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// escapePath encodes the path as the canonical uri of the signature, the slashes being kept
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = strings.Replace(url.PathEscape(segment), "+", "%2B", -1)
+	}
+	return strings.Join(segments, "/")
+}
+
+// sign adds the Authorization header of the AWS signature version 4, every header of the request being signed
+func sign(req *http.Request, payload []byte, accessKey string, secretKey string, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := hashSHA256(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{req.Method, escapePath(req.URL.Path), req.URL.Query().Encode(), canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hashSHA256([]byte(canonicalRequest))}, "\n")
+	key := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+secretKey), date), region), "s3"), "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func (store *S3Store) do(method string, name string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, store.endpoint+"/"+store.bucket+"/"+name, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if len(store.sessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", store.sessionToken)
+	}
+	sign(req, payload, store.accessKey, store.secretKey, store.region, time.Now())
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && method == "GET" {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("s3 %s %s: %s %s", method, name, resp.Status, string(body))
+	}
+	return body, nil
+}
+
+func (store *S3Store) Read(name string) ([]byte, error) {
+	return store.do("GET", name, nil)
+}
+
+// Write puts the object, replaced at once by the storage
+func (store *S3Store) Write(name string, data []byte) error {
+	_, err := store.do("PUT", name, data)
+	return err
+}
+
+func (store *S3Store) Delete(name string) error {
+	_, err := store.do("DELETE", name, nil)
+	return err
+}
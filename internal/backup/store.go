@@ -0,0 +1,120 @@
+package backup
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var ErrNotFound = errors.New("backup not found")
+
+// Store keeps the backups by name, a write replacing the previous backup atomically
+type Store interface {
+	Read(name string) ([]byte, error)
+	Write(name string, data []byte) error
+	Delete(name string) error
+}
+
+// Open returns the store of the url and the name of the backup in it:
+// /path/to/backup.json, file:///path/to/backup.json or file://relative/backup.json, s3://bucket/key?endpoint=&region= or consul://host:port/key
+func Open(rawurl string) (Store, string, error) {
+	if !strings.Contains(rawurl, "://") {
+		return NewFileStore(), rawurl, nil
+	}
+	location, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", err
+	}
+	switch location.Scheme {
+	case "file":
+		return NewFileStore(), location.Host + location.Path, nil
+	case "s3":
+		store, err := NewS3Store(location.Host, location.Query().Get("endpoint"), location.Query().Get("region"))
+		return store, strings.TrimPrefix(location.Path, "/"), err
+	case "consul":
+		return NewConsulStore(location.Host), strings.TrimPrefix(location.Path, "/"), nil
+	}
+	return nil, "", errors.New("Unknown backup store " + rawurl + ": expecting a path, file://, s3:// or consul://")
+}
+
+// Generation is the name of a previous backup, 0 being the last one
+func Generation(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return name + "." + strconv.Itoa(i)
+}
+
+// Rotate writes the backup, the previous ones being shifted to the older generations
+func Rotate(store Store, name string, data []byte, generations int) error {
+	for i := generations; i > 0; i-- {
+		previous, err := store.Read(Generation(name, i-1))
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = store.Write(Generation(name, i), previous); err != nil {
+			return err
+		}
+	}
+	return store.Write(name, data)
+}
+
+// FileStore keeps the backups on the local disk
+type FileStore struct {
+}
+
+func NewFileStore() *FileStore {
+	return &FileStore{}
+}
+
+func (store *FileStore) Read(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Write writes to a temporary file renamed once synced to disk
+func (store *FileStore) Write(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(name)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func (store *FileStore) Delete(name string) error {
+	err := os.Remove(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
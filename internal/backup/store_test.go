@@ -0,0 +1,33 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		url  string
+		kind string
+		name string
+	}{
+		{"backup.json", "*backup.FileStore", "backup.json"},
+		{"/data/backup.json", "*backup.FileStore", "/data/backup.json"},
+		{"file:///data/backup.json", "*backup.FileStore", "/data/backup.json"},
+		{"file://data/backup.json", "*backup.FileStore", "data/backup.json"},
+		{"consul://consul:8500/poller/backup.json", "*backup.ConsulStore", "poller/backup.json"},
+	}
+	for _, test := range tests {
+		store, name, err := Open(test.url)
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+			continue
+		}
+		if kind := fmt.Sprintf("%T", store); kind != test.kind || name != test.name {
+			t.Errorf("%s: got %s %s, want %s %s", test.url, kind, name, test.kind, test.name)
+		}
+	}
+	if _, _, err := Open("ftp://host/backup.json"); err == nil {
+		t.Errorf("unknown scheme: got no error")
+	}
+}
@@ -0,0 +1,243 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	poller "github.com/IRT-SystemX/bcm-poller/poller"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	MINERS   = "miners"
+	BALANCES = "balances"
+)
+
+var (
+	ErrUnknown     = errors.New("unknown label")
+	ErrDuplicate   = errors.New("label already tracked")
+	ErrUnsupported = errors.New("not supported by this cache")
+)
+
+// Manager changes the tracked events, miners and balances of a running cache
+type Manager interface {
+	AddEvent(label string, raw interface{}) error
+	RemoveEvent(label string) error
+	AddAddress(kind string, label string, id string) error
+	RemoveAddress(kind string, label string) error
+	Reload() error
+	Tracked(label string) bool
+	SetOrigin(number *big.Int)
+	Backfill(event interface{}, labels []string)
+}
+
+// Replayer processes past blocks outside of the live queue
+type Replayer interface {
+	Replay(from *big.Int, to *big.Int, apply func(poller.BlockEvent))
+}
+
+// Reprocessor processes again the blocks that failed, applied by apply or else by the connectors
+type Reprocessor interface {
+	Reprocess(apply func(poller.BlockEvent)) []*poller.Gap
+}
+
+type Admin struct {
+	manager  Manager
+	replayer Replayer
+	token    string
+	mux      sync.Mutex
+	jobs     []*BackfillJob
+}
+
+func NewAdmin(manager Manager, replayer Replayer, token string) *Admin {
+	return &Admin{manager: manager, replayer: replayer, token: token, jobs: make([]*BackfillJob, 0)}
+}
+
+func bearer(req *http.Request, token string) bool {
+	value := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(value), []byte(token)) == 1
+}
+
+func (admin *Admin) authorized(req *http.Request) bool {
+	return len(admin.token) > 0 && bearer(req, admin.token)
+}
+
+func readBody(req *http.Request) (map[interface{}]interface{}, error) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	body := make(map[interface{}]interface{})
+	if err = yaml.Unmarshal(data, &body); err != nil {
+		return nil, errors.New("invalid body: " + err.Error())
+	}
+	return body, nil
+}
+
+func parseRange(raw interface{}) (*big.Int, *big.Int, error) {
+	values, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, errors.New("invalid backfill: expecting from and to")
+	}
+	from, ok := new(big.Int).SetString(fmt.Sprint(values["from"]), 10)
+	if !ok {
+		return nil, nil, errors.New("invalid backfill: from is not a block number")
+	}
+	to, ok := new(big.Int).SetString(fmt.Sprint(values["to"]), 10)
+	if !ok {
+		return nil, nil, errors.New("invalid backfill: to is not a block number")
+	}
+	return from, to, nil
+}
+
+// backfill starts a job in the background, the blocks already counted by an event being skipped for it
+func (admin *Admin) backfill(labels []string, from *big.Int, to *big.Int) (int, error) {
+	if admin.replayer == nil {
+		return http.StatusNotImplemented, ErrUnsupported
+	}
+	for _, label := range labels {
+		if !admin.manager.Tracked(label) {
+			return http.StatusNotFound, errors.New("unknown label " + label)
+		}
+	}
+	job, err := NewBackfillJob(labels, from, to)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	admin.mux.Lock()
+	job.Id = len(admin.jobs) + 1
+	admin.jobs = append(admin.jobs, job)
+	admin.mux.Unlock()
+	go job.Run(admin.manager, admin.replayer, &admin.mux)
+	return http.StatusAccepted, nil
+}
+
+func (admin *Admin) post(kind string, body map[interface{}]interface{}) (int, error) {
+	if kind == "backfill" {
+		labels, err := unmarshalStrings("labels", body["labels"])
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		from, to, err := parseRange(body)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		return admin.backfill(labels, from, to)
+	}
+	label, _ := body["label"].(string)
+	if len(label) == 0 {
+		return http.StatusBadRequest, errors.New("missing label")
+	}
+	switch kind {
+	case "events":
+		var from, to *big.Int
+		var err error
+		if raw, ok := body["backfill"]; ok {
+			if from, to, err = parseRange(raw); err != nil {
+				return http.StatusBadRequest, err
+			}
+		}
+		delete(body, "label")
+		delete(body, "backfill")
+		if err = admin.manager.AddEvent(label, body); err != nil {
+			return statusOf(err), err
+		}
+		if from != nil {
+			return admin.backfill([]string{label}, from, to)
+		}
+	case MINERS, BALANCES:
+		id, _ := body["id"].(string)
+		if len(id) == 0 {
+			return http.StatusBadRequest, errors.New("missing id")
+		}
+		if err := admin.manager.AddAddress(kind, label, id); err != nil {
+			return statusOf(err), err
+		}
+	default:
+		return http.StatusNotFound, errors.New("unknown resource " + kind)
+	}
+	return http.StatusCreated, nil
+}
+
+func (admin *Admin) delete(kind string, label string) (int, error) {
+	var err error
+	switch kind {
+	case "events":
+		err = admin.manager.RemoveEvent(label)
+	case MINERS, BALANCES:
+		err = admin.manager.RemoveAddress(kind, label)
+	default:
+		return http.StatusNotFound, errors.New("unknown resource " + kind)
+	}
+	if err != nil {
+		return statusOf(err), err
+	}
+	return http.StatusNoContent, nil
+}
+
+func statusOf(err error) int {
+	switch err {
+	case ErrUnknown:
+		return http.StatusNotFound
+	case ErrDuplicate:
+		return http.StatusConflict
+	case ErrUnsupported:
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadRequest
+}
+
+// ServeHTTP answers POST /admin/{events,miners,balances,backfill}, DELETE /admin/{events,miners,balances}/{label},
+// GET /admin/backfill, POST /admin/reload and POST /admin/reprocess
+func (admin *Admin) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if !admin.authorized(req) {
+		http.Error(resp, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin"), "/"), "/")
+	var status int
+	var err error
+	switch {
+	case req.Method == "GET" && len(path) == 1 && path[0] == "backfill":
+		admin.mux.Lock()
+		defer admin.mux.Unlock()
+		utils.WriteJSON(resp, req, admin.jobs)
+		return
+	case req.Method == "POST" && len(path) == 1 && path[0] == "reprocess":
+		reprocessor, ok := admin.replayer.(Reprocessor)
+		if !ok {
+			status, err = http.StatusNotImplemented, ErrUnsupported
+			break
+		}
+		// the gaps are reprocessed in the background, their progress being given by /status
+		go reprocessor.Reprocess(nil)
+		status = http.StatusAccepted
+	case req.Method == "POST" && len(path) == 1 && path[0] == "reload":
+		status = http.StatusNoContent
+		if err = admin.manager.Reload(); err != nil {
+			status = http.StatusBadRequest
+		}
+	case req.Method == "POST" && len(path) == 1:
+		var body map[interface{}]interface{}
+		if body, err = readBody(req); err != nil {
+			status = http.StatusBadRequest
+		} else {
+			status, err = admin.post(path[0], body)
+		}
+	case req.Method == "DELETE" && len(path) == 2:
+		status, err = admin.delete(path[0], path[1])
+	default:
+		status, err = http.StatusMethodNotAllowed, errors.New("Method not allowed")
+	}
+	if err != nil {
+		http.Error(resp, err.Error(), status)
+		return
+	}
+	resp.WriteHeader(status)
+}
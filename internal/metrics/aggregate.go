@@ -0,0 +1,305 @@
+package metrics
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+)
+
+const (
+	maxAggregateHistory int = 128
+	// distinct samples counted exactly, beyond which the distinct aggregate is estimated by a sketch
+	maxDistinct int = 1024
+)
+
+var aggregateRegexp = regexp.MustCompile(`^\s*(\w+)\s*\(\s*(\w+)\s*\)\s*$`)
+
+type Function string
+
+const (
+	SUM      Function = "sum"
+	MIN      Function = "min"
+	MAX      Function = "max"
+	AVG      Function = "avg"
+	DISTINCT Function = "distinct"
+)
+
+// extrema of the aggregate before a block was applied, used to undo min and max on reorgs
+type aggregateSnapshot struct {
+	number *big.Int
+	min    *big.Int
+	max    *big.Int
+}
+
+type Aggregate struct {
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	Count     string `json:"count"`
+	Sum       string `json:"sum,omitempty"`
+	Min       string `json:"min,omitempty"`
+	Max       string `json:"max,omitempty"`
+	Estimated bool   `json:"estimated,omitempty"`
+	function  Function
+	field     Field
+	count     *big.Int
+	sum       *big.Int
+	min       *big.Int
+	max       *big.Int
+	history   []*aggregateSnapshot
+	distinct  map[string]int64
+	sketch    Sketch
+}
+
+func ParseAggregate(spec string) (*Aggregate, error) {
+	groups := aggregateRegexp.FindStringSubmatch(spec)
+	if groups == nil {
+		return nil, errors.New("Error parsing aggregate " + spec + ": expecting function(field)")
+	}
+	function, field := Function(groups[1]), parseField(groups[2])
+	switch function {
+	case SUM, MIN, MAX, AVG:
+		if !numericFields[field] {
+			return nil, errors.New("Error parsing aggregate " + spec + ": " + string(function) + " expects a numeric field")
+		}
+	case DISTINCT:
+		if field == UNKNOWN || field == DEPLOY {
+			return nil, errors.New("Error parsing aggregate " + spec + ": unknown field " + groups[2])
+		}
+	default:
+		return nil, errors.New("Error parsing aggregate " + spec + ": unknown function " + groups[1])
+	}
+	aggregate := &Aggregate{
+		Name:     string(function) + "(" + string(field) + ")",
+		function: function,
+		field:    field,
+		count:    big.NewInt(0),
+		sum:      big.NewInt(0),
+		history:  make([]*aggregateSnapshot, 0),
+	}
+	if function == DISTINCT {
+		aggregate.distinct = make(map[string]int64)
+	}
+	aggregate.update()
+	return aggregate, nil
+}
+
+func (aggregate *Aggregate) Function() Function {
+	return aggregate.function
+}
+
+func (aggregate *Aggregate) Field() Field {
+	return aggregate.field
+}
+
+func (aggregate *Aggregate) update() {
+	aggregate.Count = aggregate.count.String()
+	aggregate.Sum, aggregate.Min, aggregate.Max = "", "", ""
+	switch aggregate.function {
+	case SUM, AVG:
+		aggregate.Sum = aggregate.sum.String()
+	case MIN, MAX:
+		if aggregate.min != nil {
+			aggregate.Min = aggregate.min.String()
+			aggregate.Max = aggregate.max.String()
+		}
+	}
+	switch aggregate.function {
+	case SUM:
+		aggregate.Value = aggregate.sum.String()
+	case MIN:
+		aggregate.Value = aggregate.Min
+	case MAX:
+		aggregate.Value = aggregate.Max
+	case AVG:
+		if aggregate.count.Cmp(zero) > 0 {
+			aggregate.Value = new(big.Int).Div(aggregate.sum, aggregate.count).String()
+		} else {
+			aggregate.Value = "0"
+		}
+	case DISTINCT:
+		aggregate.Estimated = aggregate.sketch != nil
+		if aggregate.sketch != nil {
+			aggregate.Value = strconv.FormatInt(aggregate.sketch.Count(), 10)
+		} else {
+			aggregate.Value = strconv.Itoa(len(aggregate.distinct))
+		}
+	}
+}
+
+func (aggregate *Aggregate) snapshot(number *big.Int) {
+	size := len(aggregate.history)
+	if size > 0 && aggregate.history[size-1].number.Cmp(number) == 0 {
+		return
+	}
+	if size >= maxAggregateHistory {
+		aggregate.history = aggregate.history[1:]
+	}
+	aggregate.history = append(aggregate.history, &aggregateSnapshot{number: number, min: aggregate.min, max: aggregate.max})
+}
+
+func (aggregate *Aggregate) Apply(number *big.Int, sample string) {
+	if aggregate.function != DISTINCT {
+		aggregate.snapshot(number)
+	}
+	aggregate.Merge(sample)
+}
+
+// Merge adds a sample without history, for blocks which are not reverted
+func (aggregate *Aggregate) Merge(sample string) {
+	aggregate.count = new(big.Int).Add(aggregate.count, one)
+	if aggregate.function == DISTINCT {
+		aggregate.addDistinct(sample)
+	} else {
+		val, ok := new(big.Int).SetString(sample, 10)
+		if !ok {
+			val = big.NewInt(0)
+		}
+		aggregate.sum = new(big.Int).Add(aggregate.sum, val)
+		if aggregate.min == nil || val.Cmp(aggregate.min) < 0 {
+			aggregate.min = val
+		}
+		if aggregate.max == nil || val.Cmp(aggregate.max) > 0 {
+			aggregate.max = val
+		}
+	}
+	aggregate.update()
+}
+
+func (aggregate *Aggregate) Revert(number *big.Int, sample string) {
+	aggregate.count = new(big.Int).Sub(aggregate.count, one)
+	if aggregate.function == DISTINCT {
+		// a sample cannot be removed from the sketch, the estimate is not reverted
+		if aggregate.sketch == nil {
+			aggregate.distinct[sample]--
+			if aggregate.distinct[sample] <= 0 {
+				delete(aggregate.distinct, sample)
+			}
+		}
+	} else {
+		val, ok := new(big.Int).SetString(sample, 10)
+		if !ok {
+			val = big.NewInt(0)
+		}
+		aggregate.sum = new(big.Int).Sub(aggregate.sum, val)
+		size := len(aggregate.history)
+		if size > 0 && aggregate.history[size-1].number.Cmp(number) == 0 {
+			aggregate.min = aggregate.history[size-1].min
+			aggregate.max = aggregate.history[size-1].max
+			aggregate.history = aggregate.history[:size-1]
+		}
+	}
+	aggregate.update()
+}
+
+// addDistinct counts the sample, switching to the sketch when there are too many distinct samples to keep
+func (aggregate *Aggregate) addDistinct(sample string) {
+	if aggregate.sketch != nil {
+		aggregate.sketch.Add(sample)
+		return
+	}
+	aggregate.distinct[sample]++
+	aggregate.estimate()
+}
+
+func (aggregate *Aggregate) estimate() {
+	if len(aggregate.distinct) > maxDistinct {
+		aggregate.sketch = NewSketch()
+		for key := range aggregate.distinct {
+			aggregate.sketch.Add(key)
+		}
+		aggregate.distinct = nil
+	}
+}
+
+func parseBig(value interface{}) *big.Int {
+	str, ok := value.(string)
+	if !ok || len(str) == 0 {
+		return nil
+	}
+	val, _ := new(big.Int).SetString(str, 10)
+	return val
+}
+
+func (aggregate *Aggregate) restore(raw map[interface{}]interface{}) {
+	if val := parseBig(raw["count"]); val != nil {
+		aggregate.count = val
+	}
+	if val := parseBig(raw["sum"]); val != nil {
+		aggregate.sum = val
+	}
+	aggregate.min = parseBig(raw["min"])
+	aggregate.max = parseBig(raw["max"])
+	// the samples of a backup before the distinct state was kept apart
+	if distinct, ok := raw["distinct"].(map[interface{}]interface{}); ok && aggregate.function == DISTINCT {
+		aggregate.restoreDistinct(distinct, nil)
+	}
+	aggregate.update()
+}
+
+// distinctState is the state of a distinct aggregate in the backup, apart from /tracking
+type distinctState struct {
+	Samples map[string]int64 `json:"samples,omitempty"`
+	Sketch  Sketch           `json:"sketch,omitempty"`
+}
+
+func (aggregate *Aggregate) restoreDistinct(samples map[interface{}]interface{}, sketch []byte) {
+	if len(sketch) == len(NewSketch()) {
+		aggregate.distinct, aggregate.sketch = nil, Sketch(sketch)
+		return
+	}
+	aggregate.distinct, aggregate.sketch = make(map[string]int64), nil
+	for key, value := range samples {
+		if count := toInt(value); count > 0 {
+			aggregate.distinct[fmt.Sprint(key)] = count
+		}
+	}
+	aggregate.estimate()
+}
+
+// Distincts keeps the state of the distinct aggregates of the events in the backup
+type Distincts struct {
+	events *[]*Event
+}
+
+func NewDistincts(events *[]*Event) *Distincts {
+	return &Distincts{events: events}
+}
+
+func (distincts *Distincts) MarshalJSON() ([]byte, error) {
+	states := make(map[string]map[string]*distinctState)
+	for _, event := range *distincts.events {
+		for _, aggregate := range event.Aggregates {
+			if aggregate.function != DISTINCT {
+				continue
+			}
+			if states[event.Label] == nil {
+				states[event.Label] = make(map[string]*distinctState)
+			}
+			states[event.Label][aggregate.Name] = &distinctState{Samples: aggregate.distinct, Sketch: aggregate.sketch}
+		}
+	}
+	return json.Marshal(states)
+}
+
+// Restore reads the distinct aggregates of the events from the backup
+func (distincts *Distincts) Restore(raw interface{}) {
+	states, _ := raw.(map[interface{}]interface{})
+	for _, event := range *distincts.events {
+		aggregates, _ := states[event.Label].(map[interface{}]interface{})
+		for _, aggregate := range event.Aggregates {
+			state, ok := aggregates[aggregate.Name].(map[interface{}]interface{})
+			if !ok || aggregate.function != DISTINCT {
+				continue
+			}
+			samples, _ := state["samples"].(map[interface{}]interface{})
+			sketch, _ := state["sketch"].(string)
+			decoded, _ := base64.StdEncoding.DecodeString(sketch)
+			aggregate.restoreDistinct(samples, decoded)
+			aggregate.update()
+		}
+	}
+}
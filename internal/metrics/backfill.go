@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"errors"
+	poller "github.com/IRT-SystemX/bcm-poller/poller"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+)
+
+const (
+	RUNNING = "running"
+	DONE    = "done"
+)
+
+// BlockRange is a range of blocks (included) merged into an event by a backfill
+type BlockRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	from *big.Int
+	to   *big.Int
+}
+
+func NewBlockRange(from *big.Int, to *big.Int) *BlockRange {
+	return &BlockRange{From: from.String(), To: to.String(), from: from, to: to}
+}
+
+func (blockRange *BlockRange) contains(number *big.Int) bool {
+	return blockRange.from.Cmp(number) <= 0 && blockRange.to.Cmp(number) >= 0
+}
+
+// Covered tells if a block was already counted by the event, either live or by a backfill
+func (event *Event) Covered(number *big.Int) bool {
+	if event.origin != nil && number.Cmp(event.origin) >= 0 {
+		return true
+	}
+	for _, blockRange := range event.Backfilled {
+		if blockRange.contains(number) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cover records a backfilled block, merging the contiguous ranges
+func (event *Event) Cover(number *big.Int) {
+	if event.Covered(number) {
+		return
+	}
+	ranges := event.Backfilled
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].from.Cmp(number) > 0
+	})
+	next := new(big.Int).Add(number, one)
+	if i > 0 && new(big.Int).Add(ranges[i-1].to, one).Cmp(number) == 0 {
+		to := number
+		if i < len(ranges) && ranges[i].from.Cmp(next) == 0 {
+			to = ranges[i].to
+			ranges = append(ranges[:i], ranges[i+1:]...)
+		}
+		ranges[i-1] = NewBlockRange(ranges[i-1].from, to)
+	} else if i < len(ranges) && ranges[i].from.Cmp(next) == 0 {
+		ranges[i] = NewBlockRange(number, ranges[i].to)
+	} else {
+		ranges = append(ranges, nil)
+		copy(ranges[i+1:], ranges[i:])
+		ranges[i] = NewBlockRange(number, number)
+	}
+	event.Backfilled = ranges
+}
+
+type BackfillJob struct {
+	Id      int      `json:"id"`
+	Labels  []string `json:"labels"`
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Current string   `json:"current"`
+	Status  string   `json:"status"`
+	from    *big.Int
+	to      *big.Int
+}
+
+func NewBackfillJob(labels []string, from *big.Int, to *big.Int) (*BackfillJob, error) {
+	if len(labels) == 0 {
+		return nil, errors.New("missing labels")
+	}
+	if from == nil || to == nil || from.Sign() < 0 || to.Cmp(from) < 0 {
+		return nil, errors.New("invalid range of blocks")
+	}
+	return &BackfillJob{Labels: labels, From: from.String(), To: to.String(), Status: RUNNING, from: from, to: to}, nil
+}
+
+// Run replays the range of blocks through the processor and merges the matches of the labels into the manager
+func (job *BackfillJob) Run(manager Manager, replayer Replayer, mux *sync.Mutex) {
+	log.Printf("Backfill %v from block #%s to #%s", job.Labels, job.From, job.To)
+	replayer.Replay(job.from, job.to, func(blockEvent poller.BlockEvent) {
+		manager.Backfill(blockEvent, job.Labels)
+		mux.Lock()
+		job.Current = blockEvent.Number().String()
+		mux.Unlock()
+	})
+	mux.Lock()
+	job.Status = DONE
+	mux.Unlock()
+	log.Printf("Backfill %v done", job.Labels)
+}
@@ -0,0 +1,244 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	backup "github.com/IRT-SystemX/bcm-poller/internal/backup"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
+	"gopkg.in/yaml.v2"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// version of the schema of the backup, the backups without version being 1
+	backupVersion int = 2
+	// number of previous backups kept as backup.json.1, backup.json.2...
+	backupGenerations int = 3
+)
+
+// migrations[i] upgrades a backup from the version i+1
+var migrations = []func(raw map[string]interface{}){
+	// the head of the chain was not recorded, the restore is not verified
+	func(raw map[string]interface{}) {
+		raw["head"] = map[interface{}]interface{}{}
+	},
+}
+
+// Head is the last block applied, checked against the chain on restore
+type Head struct {
+	Number string `json:"number"`
+	Hash   string `json:"hash"`
+}
+
+func readBackup(store backup.Store, name string) (map[string]interface{}, error) {
+	data, err := store.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]interface{})
+	if err = yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	if _, ok := raw["stats"].(map[interface{}]interface{}); !ok {
+		return nil, errors.New("no stats")
+	}
+	version := int(toInt(raw["version"]))
+	if version == 0 {
+		version = 1
+	}
+	if version > backupVersion {
+		return nil, errors.New("version " + strconv.Itoa(version) + " newer than " + strconv.Itoa(backupVersion))
+	}
+	for ; version < backupVersion; version++ {
+		log.Printf("Migrating backup %s from version %d", name, version)
+		migrations[version-1](raw)
+	}
+	return raw, nil
+}
+
+// Snapshot is a backup marshaled under the lock of the cache, written once the lock is released
+type Snapshot struct {
+	data     []byte
+	sequence int64
+}
+
+// snapshot marshals the backup, the lock of the cache being held
+func (cache *RawCache) snapshot() (*Snapshot, error) {
+	data := map[string]interface{}{"version": backupVersion, "head": cache.head}
+	for key, value := range cache.Backup {
+		data[key] = value
+	}
+	jsonBytes, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return nil, utils.NewError(utils.ErrBackup, err)
+	}
+	cache.saved = cache.Stats["block"].Current
+	cache.sequence++
+	return &Snapshot{data: jsonBytes, sequence: cache.sequence}, nil
+}
+
+// write stores the snapshot unless a more recent one was already written
+func (cache *RawCache) write(snapshot *Snapshot) error {
+	cache.writeMux.Lock()
+	defer cache.writeMux.Unlock()
+	if snapshot.sequence <= cache.written {
+		return nil
+	}
+	log.Println("Backuping stats..")
+	if err := backup.Rotate(cache.store, cache.backupFile, snapshot.data, cache.generations); err != nil {
+		return utils.NewError(utils.ErrBackup, err)
+	}
+	cache.written = snapshot.sequence
+	return nil
+}
+
+func (cache *RawCache) storeBackup() error {
+	snapshot, err := cache.snapshot()
+	if err != nil {
+		return err
+	}
+	return cache.write(snapshot)
+}
+
+// SetGenerations keeps the number of previous backups
+func (cache *RawCache) SetGenerations(generations int) {
+	cache.generations = generations
+}
+
+// ApplyHead records the block applied if it is the last one
+func (cache *RawCache) ApplyHead(number *big.Int, hash string) {
+	current, ok := new(big.Int).SetString(cache.head.Number, 10)
+	if !ok || number.Cmp(current) >= 0 {
+		cache.head = &Head{Number: number.String(), Hash: hash}
+	}
+}
+
+// RevertHead records the parent of the block reverted
+func (cache *RawCache) RevertHead(number *big.Int, parentHash string) {
+	current, ok := new(big.Int).SetString(cache.head.Number, 10)
+	if !ok || number.Cmp(current) <= 0 {
+		cache.head = &Head{Number: new(big.Int).Sub(number, one).String(), Hash: parentHash}
+	}
+}
+
+// Head returns the last block applied of the backup restored, empty if not known
+func (cache *RawCache) Head() *Head {
+	return cache.head
+}
+
+// LoadBackup reads the backup, or the most recent generation readable if it is corrupted
+func (cache *RawCache) LoadBackup() (map[string]interface{}, error) {
+	if cache.restored != nil {
+		return cache.restored, nil
+	}
+	if cache.store == nil {
+		return nil, nil
+	}
+	if _, err := cache.store.Read(cache.backupFile); err == backup.ErrNotFound {
+		return nil, nil
+	}
+	for i := 0; i <= cache.generations; i++ {
+		name := backup.Generation(cache.backupFile, i)
+		raw, err := readBackup(cache.store, name)
+		if err != nil {
+			log.Printf("Error reading backup %s: %v", name, err)
+			continue
+		}
+		if head, ok := raw["head"].(map[interface{}]interface{}); ok {
+			number, _ := head["number"].(string)
+			hash, _ := head["hash"].(string)
+			cache.head = &Head{Number: number, Hash: hash}
+		}
+		cache.restored = raw
+		return raw, nil
+	}
+	return nil, utils.NewError(utils.ErrBackup, errors.New("no readable backup "+cache.backupFile))
+}
+
+// Flush writes the backup whatever the frequency
+func (cache *RawCache) Flush() error {
+	if cache.store != nil {
+		return cache.storeBackup()
+	}
+	return nil
+}
+
+// Save marshals the backup once the frequency of blocks applied, or reverted, since the last backup is reached,
+// to be written by Write once the lock of the cache is released, nil otherwise
+func (cache *RawCache) Save() *Snapshot {
+	if cache.store != nil && cache.backupFrequency.Cmp(zero) != 0 && new(big.Int).Abs(new(big.Int).Sub(cache.Stats["block"].Current, cache.saved)).Cmp(cache.backupFrequency) >= 0 {
+		snapshot, err := cache.snapshot()
+		if err != nil {
+			log.Println("Error backup: ", err)
+		}
+		return snapshot
+	}
+	return nil
+}
+
+// Write stores the snapshot of Save if any, an error being retried at the next backup
+func (cache *RawCache) Write(snapshot *Snapshot) {
+	if snapshot != nil {
+		if err := cache.write(snapshot); err != nil {
+			log.Println("Error backup: ", err)
+		}
+	}
+}
+
+// Checkpoint writes the backup on demand, marshaled between two blocks
+func (cache *RawCache) Checkpoint() error {
+	if cache.store == nil {
+		return errors.New("no backup path")
+	}
+	cache.Lock()
+	snapshot, err := cache.snapshot()
+	cache.Unlock()
+	if err != nil {
+		return err
+	}
+	return cache.write(snapshot)
+}
+
+// StartBackups writes the backup at every interval
+func (cache *RawCache) StartBackups(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := cache.Checkpoint(); err != nil {
+				log.Println("Error backup: ", err)
+			}
+		}
+	}()
+}
+
+type backupHandler struct {
+	cache *RawCache
+	token string
+}
+
+// NewBackupHandler writes the backup on POST /backup with the bearer token, refusing every request without token as
+// the admin API
+func NewBackupHandler(cache *RawCache, token string) http.Handler {
+	return &backupHandler{cache: cache, token: token}
+}
+
+func (handler *backupHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if len(handler.token) == 0 || !bearer(req, handler.token) {
+		http.Error(resp, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "POST" {
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := handler.cache.Checkpoint(); err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	handler.cache.RLock()
+	defer handler.cache.RUnlock()
+	utils.WriteJSON(resp, req, handler.cache.head)
+}
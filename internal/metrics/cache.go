@@ -1,14 +1,15 @@
 package metrics
 
 import (
-	"encoding/json"
 	"errors"
+	backup "github.com/IRT-SystemX/bcm-poller/internal/backup"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
 	"math/big"
 	"os"
-	"strings"
+	"sync"
 )
 
 var (
@@ -17,23 +18,28 @@ var (
 )
 
 type Stats struct {
-	Current     *big.Int `json:"-"`
-	Count       string   `json:"count"`
-	Interval    uint64   `json:"interval"`
-	Timestamp   uint64   `json:"timestamp"`
-	BlockNumber string   `json:"block"`
+	Current     *big.Int  `json:"-"`
+	Count       string    `json:"count"`
+	Interval    uint64    `json:"interval"`
+	Timestamp   uint64    `json:"timestamp"`
+	BlockNumber string    `json:"block"`
+	Windows     []*Window `json:"windows,omitempty"`
 }
 
 func NewStats() *Stats {
 	return &Stats{Current: big.NewInt(0), Count: "0"}
 }
 
+func (stats *Stats) SetWindows(windows []*Window) {
+	stats.Windows = windows
+}
+
 func (stats *Stats) Increment(timestamp uint64, number *big.Int) {
-	stats.Update(one, timestamp, number.String())
+	stats.Update(one, timestamp, number)
 }
 
-func (stats *Stats) Decrement() {
-	stats.Substract(one)
+func (stats *Stats) Decrement(number *big.Int) {
+	stats.Rollback(one, number)
 }
 
 func (stats *Stats) Add(incr *big.Int) {
@@ -42,117 +48,223 @@ func (stats *Stats) Add(incr *big.Int) {
 
 func (stats *Stats) Substract(incr *big.Int) {
 	stats.Current = new(big.Int).Sub(stats.Current, incr)
+	stats.Count = stats.Current.String()
 }
 
-func (stats *Stats) Update(incr *big.Int, timestamp uint64, number string) {
+func (stats *Stats) Update(incr *big.Int, timestamp uint64, number *big.Int) {
 	stats.Add(incr)
 	stats.Count = stats.Current.String()
-	if stats.Timestamp != 0 && timestamp-stats.Timestamp > 0 {
-		stats.Interval = timestamp - stats.Timestamp
+	// a block older than the last one, a gap reprocessed for instance, does not change the last block
+	if last, ok := new(big.Int).SetString(stats.BlockNumber, 10); !ok || number.Cmp(last) >= 0 {
+		if stats.Timestamp != 0 && timestamp > stats.Timestamp {
+			stats.Interval = timestamp - stats.Timestamp
+		}
+		stats.Timestamp = timestamp
+		stats.BlockNumber = number.String()
+	}
+	for _, window := range stats.Windows {
+		window.Add(incr, timestamp, number)
+	}
+}
+
+func (stats *Stats) Rollback(incr *big.Int, number *big.Int) {
+	stats.Substract(incr)
+	for _, window := range stats.Windows {
+		window.Remove(incr, number)
+	}
+}
+
+func (stats *Stats) Tick(timestamp uint64, number *big.Int) {
+	for _, window := range stats.Windows {
+		window.Tick(timestamp, number)
+	}
+}
+
+func (stats *Stats) Untick(number *big.Int) {
+	for _, window := range stats.Windows {
+		window.Untick(number)
 	}
-	stats.Timestamp = timestamp
-	stats.BlockNumber = number
 }
 
 type Event struct {
 	Stats
-	rules []*EventRule
-	Label string `json:"label"`
+	expr       Expr
+	rules      []*EventRule
+	origin     *big.Int
+	Label      string        `json:"label"`
+	Aggregates []*Aggregate  `json:"aggregates,omitempty"`
+	Since      string        `json:"since,omitempty"`
+	Backfilled []*BlockRange `json:"backfilled,omitempty"`
 }
 
 func (event *Event) Rules() []*EventRule {
 	return event.rules
 }
 
-func NewEvent(key string, rules []*EventRule) *Event {
-	event := &Event{rules: rules, Label: key}
-	event.Current = big.NewInt(0)
-	event.Count = "0"
-	return event
+func (event *Event) Match(check func(*EventRule) bool) bool {
+	return event.expr.Eval(check)
 }
 
-type EventRule struct {
-	Field    Field
-	Operator Operator
-	Value    string
+func (event *Event) Apply(timestamp uint64, number *big.Int, sample func(Field) string) {
+	event.Increment(timestamp, number)
+	for _, aggregate := range event.Aggregates {
+		aggregate.Apply(number, sample(aggregate.Field()))
+	}
 }
 
-type Field string
+// Merge counts a transaction of a past block, below the head of the stats and out of the windows
+func (event *Event) Merge(sample func(Field) string) {
+	event.Add(one)
+	event.Count = event.Current.String()
+	for _, aggregate := range event.Aggregates {
+		aggregate.Merge(sample(aggregate.Field()))
+	}
+}
 
-const (
-	FROM    Field = "from"
-	TO      Field = "to"
-	VALUE   Field = "value"
-	DEPLOY  Field = "deploy"
-	METHOD  Field = "method"
-	UNKNOWN Field = ""
-)
+// Origin is the first block applied live to the event
+func (event *Event) Origin() *big.Int {
+	return event.origin
+}
 
-var fields = [...]Field{FROM, TO, VALUE, DEPLOY, METHOD, UNKNOWN}
+// SetOrigin starts the event at the block, or at the next block applied if nil
+func (event *Event) SetOrigin(number *big.Int) {
+	event.origin = number
+	event.Since = ""
+	if number != nil {
+		event.Since = number.String()
+	}
+}
 
-func parseField(field string) Field {
-	for _, f := range fields {
-		if field == string(f) {
-			return f
-		}
+func (event *Event) Revert(number *big.Int, sample func(Field) string) {
+	event.Decrement(number)
+	for _, aggregate := range event.Aggregates {
+		aggregate.Revert(number, sample(aggregate.Field()))
 	}
-	return UNKNOWN
 }
 
-type Operator string
+func NewEvent(key string, expr Expr) *Event {
+	event := &Event{expr: expr, rules: make([]*EventRule, 0), Label: key}
+	expr.Walk(func(rule *EventRule) {
+		event.rules = append(event.rules, rule)
+	})
+	event.Current = big.NewInt(0)
+	event.Count = "0"
+	return event
+}
 
-const (
-	EQ   Operator = "="
-	LT   Operator = "<="
-	GT   Operator = ">="
-	NONE Operator = ""
-)
+func unmarshalRules(key string, value interface{}) (Expr, error) {
+	var arr []interface{}
+	switch val := value.(type) {
+	case string:
+		arr = []interface{}{val}
+	case []interface{}:
+		arr = val
+	default:
+		return nil, errors.New("Error parsing event " + key + ": expecting a rule or a list of rules")
+	}
+	var expr Expr
+	for _, val := range arr {
+		str, ok := val.(string)
+		if !ok {
+			return nil, errors.New("Error parsing event " + key + ": expecting a rule")
+		}
+		rule, err := ParseRule(str)
+		if err != nil {
+			err.(*ParseError).Label = key
+			return nil, err
+		}
+		if expr == nil {
+			expr = rule
+		} else {
+			expr = &AndExpr{Left: expr, Right: rule}
+		}
+	}
+	if expr == nil {
+		return nil, errors.New("Error parsing event " + key + ": no rule")
+	}
+	return expr, nil
+}
 
-var operators = [...]Operator{EQ, LT, GT, NONE}
+func unmarshalStrings(key string, value interface{}) ([]string, error) {
+	switch val := value.(type) {
+	case nil:
+		return []string{}, nil
+	case string:
+		return []string{val}, nil
+	case []interface{}:
+		output := make([]string, len(val))
+		for i, item := range val {
+			str, ok := item.(string)
+			if !ok {
+				return nil, errors.New("Error parsing " + key + ": expecting a string")
+			}
+			output[i] = str
+		}
+		return output, nil
+	}
+	return nil, errors.New("Error parsing " + key + ": expecting a string or a list of strings")
+}
 
-func parseOperator(op string) Operator {
-	for _, o := range operators {
-		if op == string(o) {
-			return o
+// an event is either a list of rules or a map with the rules and its options
+func UnmarshalEvent(key string, value interface{}) (*Event, error) {
+	options, ok := value.(map[interface{}]interface{})
+	if !ok {
+		expr, err := unmarshalRules(key, value)
+		if err != nil {
+			return nil, err
+		}
+		return NewEvent(key, expr), nil
+	}
+	expr, err := unmarshalRules(key, options["rules"])
+	if err != nil {
+		return nil, err
+	}
+	event := NewEvent(key, expr)
+	aggregates, err := unmarshalStrings(key, options["aggregate"])
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range aggregates {
+		aggregate, err := ParseAggregate(spec)
+		if err != nil {
+			return nil, errors.New("Error parsing event " + key + ": " + err.Error())
 		}
+		event.Aggregates = append(event.Aggregates, aggregate)
+	}
+	windows, err := UnmarshalWindows(options, "windows")
+	if err != nil {
+		return nil, errors.New("Error parsing event " + key + ": " + err.Error())
 	}
-	return NONE
+	event.SetWindows(windows)
+	return event, nil
 }
 
-func UnmarshalEvents(raw map[interface{}]interface{}, field string) map[string][]*EventRule {
-	output := make(map[string][]*EventRule)
+func UnmarshalWindows(raw map[interface{}]interface{}, field string) ([]*Window, error) {
+	specs, err := unmarshalStrings(field, raw[field])
+	if err != nil {
+		return nil, err
+	}
+	return ParseWindows(specs)
+}
+
+func UnmarshalEvents(raw map[interface{}]interface{}, field string) ([]*Event, error) {
+	output := make([]*Event, 0)
 	_, ok := raw[field]
 	if !ok {
-		return output
+		return output, nil
+	}
+	tab, ok := raw[field].(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("Error parsing " + field + ": expecting a map of rules")
 	}
-	tab := raw[field].(map[interface{}]interface{})
 	for key, value := range tab {
-		arr := value.([]interface{})
-		rules := make([]*EventRule, len(arr))
-		for i, val := range arr {
-			words := strings.Fields(val.(string))
-			if len(words) == 1 || len(words) == 3 {
-				var field Field = parseField(words[0])
-				if field == UNKNOWN {
-					log.Fatal(errors.New("Error parsing rule: " + val.(string)))
-				}
-				var operator Operator = NONE
-				var value string = ""
-				if len(words) == 3 {
-					operator = parseOperator(words[1])
-					if ((field == FROM || field == TO) && operator != EQ) || operator == NONE {
-						log.Fatal(errors.New("Error parsing rule: " + val.(string)))
-					}
-					value = words[2]
-				}
-				rules[i] = &EventRule{Field: field, Operator: operator, Value: value}
-			} else {
-				log.Fatal(errors.New("Error parsing rule: " + val.(string)))
-			}
+		event, err := UnmarshalEvent(key.(string), value)
+		if err != nil {
+			return nil, err
 		}
-		output[key.(string)] = rules
+		output = append(output, event)
 	}
-	return output
+	return output, nil
 }
 
 func UnmarshalTrackingEvents(arr []interface{}, events []*Event) {
@@ -161,6 +273,27 @@ func UnmarshalTrackingEvents(arr []interface{}, events []*Event) {
 			if x.Label == obj.(map[interface{}]interface{})["label"] {
 				x.Count = obj.(map[interface{}]interface{})["count"].(string)
 				x.Current, _ = new(big.Int).SetString(x.Count, 10)
+				// a backup without origin may hold any past block
+				since := parseBig(obj.(map[interface{}]interface{})["since"])
+				if since == nil {
+					since = big.NewInt(0)
+				}
+				x.SetOrigin(since)
+				backfilled, _ := obj.(map[interface{}]interface{})["backfilled"].([]interface{})
+				for _, raw := range backfilled {
+					from, to := parseBig(raw.(map[interface{}]interface{})["from"]), parseBig(raw.(map[interface{}]interface{})["to"])
+					if from != nil && to != nil {
+						x.Backfilled = append(x.Backfilled, NewBlockRange(from, to))
+					}
+				}
+				aggregates, _ := obj.(map[interface{}]interface{})["aggregates"].([]interface{})
+				for _, raw := range aggregates {
+					for _, aggregate := range x.Aggregates {
+						if aggregate.Name == raw.(map[interface{}]interface{})["name"] {
+							aggregate.restore(raw.(map[interface{}]interface{}))
+						}
+					}
+				}
 			}
 		}
 	}
@@ -169,98 +302,180 @@ func UnmarshalTrackingEvents(arr []interface{}, events []*Event) {
 func unmarshalStats(key string, value map[interface{}]interface{}, stats map[string]*Stats) {
 	x, ok := stats[key]
 	if !ok {
-		log.Fatal(errors.New("Backup key " + key + " not found in config"))
+		x = NewStats()
+		stats[key] = x
 	}
 	x.Count = value["count"].(string)
 	x.Current, _ = new(big.Int).SetString(x.Count, 10)
+	x.BlockNumber, _ = value["block"].(string)
+	x.Timestamp = uint64(toInt(value["timestamp"]))
+	x.Interval = uint64(toInt(value["interval"]))
 }
 
-func storeBackup(pathFile string, data map[string]interface{}) {
-	log.Println("Backuping stats..")
-	jsonBytes, err := json.MarshalIndent(data, "", "\t")
+func ReadConfig(pathFile string) (map[interface{}]interface{}, error) {
+	_, err := os.Stat(pathFile)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil
 	}
-	if err = ioutil.WriteFile(pathFile, jsonBytes, os.ModePerm); err != nil {
-		log.Fatal("Error writing backup file", err)
+	data, err := ioutil.ReadFile(pathFile)
+	if err != nil {
+		return nil, utils.NewError(utils.ErrConfig, err)
 	}
+	raw := make(map[interface{}]interface{})
+	if err = yaml.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, utils.NewError(utils.ErrConfig, errors.New("Error parsing "+pathFile+": "+err.Error()))
+	}
+	log.Printf("Tracking configuration " + pathFile)
+	return raw, nil
 }
 
-func LoadConfig(pathFile string) map[interface{}]interface{} {
-	_, err := os.Stat(pathFile)
-	if err == nil {
-		data, err := ioutil.ReadFile(pathFile)
-		if err != nil {
-			log.Fatal(err)
+// MergeEvents keeps the counters of the events still configured and starts the new ones at the origin block
+func MergeEvents(current []*Event, next []*Event, origin *big.Int) []*Event {
+	output := make([]*Event, 0, len(next))
+	for _, event := range next {
+		found := false
+		for _, x := range current {
+			if x.Label == event.Label {
+				output = append(output, x)
+				found = true
+				break
+			}
 		}
-		raw := make(map[interface{}]interface{})
-		err = yaml.Unmarshal([]byte(data), &raw)
-		if err != nil {
-			log.Fatalf("error: %v", err)
+		if !found {
+			log.Printf("Tracking event %s from block #%s", event.Label, origin)
+			event.SetOrigin(origin)
+			output = append(output, event)
 		}
-		log.Printf("Tracking configuration " + pathFile)
-		return raw
 	}
-	return nil
+	return output
 }
 
 type RawCache struct {
+	sync.RWMutex
 	ready           bool
 	backupFile      string
+	store           backup.Store
 	backupFrequency *big.Int
+	generations     int
+	head            *Head
+	saved           *big.Int
+	sequence        int64
+	writeMux        sync.Mutex
+	written         int64
+	restored        map[string]interface{}
 	Stats           map[string]*Stats
 	Backup          map[string]interface{}
+	observers       []Observer
 }
 
-func NewRawCache(backupFile string, restore bool, backupFrequency int64) *RawCache {
+func NewRawCache(backupFile string, restore bool, backupFrequency int64) (*RawCache, error) {
 	cache := &RawCache{
 		backupFile:      backupFile,
 		backupFrequency: big.NewInt(backupFrequency),
+		generations:     backupGenerations,
+		head:            &Head{},
 		Stats:           map[string]*Stats{"block": NewStats(), "transaction": NewStats()},
 	}
-	_, err := os.Stat(backupFile)
-	if restore && err != nil {
-		log.Fatal(err)
+	if len(backupFile) > 0 {
+		store, name, err := backup.Open(backupFile)
+		if err != nil {
+			return nil, utils.NewError(utils.ErrConfig, err)
+		}
+		cache.store = store
+		cache.backupFile = name
+		_, err = store.Read(name)
+		if restore && err != nil {
+			return nil, utils.NewError(utils.ErrBackup, err)
+		}
+		if !restore && err == nil {
+			store.Delete(name)
+		}
 	}
-	if !restore && err == nil {
-		os.Remove(backupFile)
+	raw, err := cache.LoadBackup()
+	if err != nil {
+		return nil, err
 	}
-	raw := cache.LoadBackup()
 	if raw != nil {
 		for key, value := range raw["stats"].(map[interface{}]interface{}) {
 			unmarshalStats(key.(string), value.(map[interface{}]interface{}), cache.Stats)
 		}
 	}
-	return cache
+	cache.saved = cache.Stats["block"].Current
+	return cache, nil
 }
 
-func (cache *RawCache) Ready() bool {
-	return cache.ready
+// every stats counts over its own copy of the windows
+func (cache *RawCache) SetWindows(raw map[interface{}]interface{}) error {
+	if raw == nil {
+		return nil
+	}
+	for _, stats := range cache.Stats {
+		windows, err := UnmarshalWindows(raw, "windows")
+		if err != nil {
+			return err
+		}
+		stats.SetWindows(windows)
+	}
+	return nil
 }
 
-func (cache *RawCache) SetReady() {
-	cache.ready = true
+func (cache *RawCache) Tick(timestamp uint64, number *big.Int) {
+	for _, stats := range cache.Stats {
+		stats.Tick(timestamp, number)
+	}
 }
 
-func (cache *RawCache) LoadBackup() map[string]interface{} {
-	_, err := os.Stat(cache.backupFile)
-	if err == nil {
-		data, err := ioutil.ReadFile(cache.backupFile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		raw := make(map[string]interface{})
-		err = yaml.Unmarshal([]byte(data), &raw)
-		if err != nil {
-			log.Fatalf("error: %v", err)
+func (cache *RawCache) Untick(number *big.Int) {
+	for _, stats := range cache.Stats {
+		stats.Untick(number)
+	}
+}
+
+// Origin is the next block to be applied, where events added at runtime start counting, nil if no block is known yet
+func (cache *RawCache) Origin() *big.Int {
+	number, ok := new(big.Int).SetString(cache.Stats["block"].BlockNumber, 10)
+	if !ok {
+		number, ok = new(big.Int).SetString(cache.head.Number, 10)
+	}
+	if !ok {
+		return nil
+	}
+	return new(big.Int).Add(number, one)
+}
+
+// StartEvents sets the origin of the events added before any block was known at the block applied
+func StartEvents(events []*Event, number *big.Int) {
+	for _, event := range events {
+		if event.Origin() == nil {
+			event.SetOrigin(new(big.Int).Set(number))
 		}
-		return raw
 	}
-	return nil
 }
 
-func (cache *RawCache) Save() {
-	if len(cache.backupFile) > 0 && cache.backupFrequency.Cmp(zero) != 0 && new(big.Int).Mod(cache.Stats["block"].Current, cache.backupFrequency).Cmp(zero) == 0 {
-		storeBackup(cache.backupFile, cache.Backup)
+// BlockTime returns the time between the last two blocks applied, in seconds
+func (cache *RawCache) BlockTime() uint64 {
+	cache.RLock()
+	defer cache.RUnlock()
+	return cache.Stats["block"].Interval
+}
+
+func (cache *RawCache) AddObserver(observer Observer) {
+	cache.observers = append(cache.observers, observer)
+}
+
+// Notify sends the notifications to the observers, out of the lock of the cache
+func (cache *RawCache) Notify(notifications ...*Notification) {
+	for _, notification := range notifications {
+		for _, observer := range cache.observers {
+			observer.Notify(notification)
+		}
 	}
 }
+
+func (cache *RawCache) Ready() bool {
+	return cache.ready
+}
+
+func (cache *RawCache) SetReady() {
+	cache.ready = true
+}
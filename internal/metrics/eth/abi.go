@@ -0,0 +1,152 @@
+package eth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+)
+
+// Abis resolves the method and event names of the abis of every contract, or of the abis attached to a contract
+type Abis struct {
+	methods   map[string][]string
+	events    map[string][]string
+	contracts map[string]*Abis
+}
+
+func NewAbis() *Abis {
+	return &Abis{methods: make(map[string][]string), events: make(map[string][]string), contracts: make(map[string]*Abis)}
+}
+
+// abiFile is an abi of the config, attached to the contract of the address if any
+type abiFile struct {
+	file    string
+	address string
+}
+
+func readAbi(pathFile string) (abi.ABI, error) {
+	data, err := ioutil.ReadFile(pathFile)
+	if err != nil {
+		return abi.ABI{}, err
+	}
+	contract, err := abi.JSON(bytes.NewReader(data))
+	if err == nil {
+		return contract, nil
+	}
+	// compilation artifacts (truffle, hardhat) wrap the abi in an object
+	var artifact struct {
+		Abi json.RawMessage `json:"abi"`
+	}
+	if json.Unmarshal(data, &artifact) != nil || len(artifact.Abi) == 0 {
+		return abi.ABI{}, err
+	}
+	return abi.JSON(bytes.NewReader(artifact.Abi))
+}
+
+func appendId(ids []string, id string) []string {
+	for _, val := range ids {
+		if val == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+// Load reads the abi of the file, attached to the contract of the address or to every contract if empty
+func (abis *Abis) Load(label string, pathFile string, address string) error {
+	contract, err := readAbi(pathFile)
+	if err != nil {
+		return errors.New("Error loading abi " + label + " (" + pathFile + "): " + err.Error())
+	}
+	if len(address) > 0 {
+		if !common.IsHexAddress(address) {
+			return errors.New("Error loading abi " + label + ": invalid address " + address)
+		}
+		address = common.HexToAddress(address).Hex()
+		if abis.contracts[address] == nil {
+			abis.contracts[address] = NewAbis()
+		}
+		log.Printf("Attaching abi %s to %s", label, address)
+		return abis.contracts[address].Load(label, pathFile, "")
+	}
+	for _, method := range contract.Methods {
+		abis.methods[method.RawName] = appendId(abis.methods[method.RawName], hexutil.Encode(method.ID()))
+	}
+	for _, event := range contract.Events {
+		abis.events[event.RawName] = appendId(abis.events[event.RawName], event.ID().Hex())
+	}
+	log.Printf("Loading abi %s (%d methods, %d events)", label, len(contract.Methods), len(contract.Events))
+	return nil
+}
+
+// lookup returns the ids of the name in the abis attached to the contracts, or in the abis of every contract for the
+// contracts without an abi attached or when no contract is given
+func (abis *Abis) lookup(ids func(*Abis) []string, contracts []string) []string {
+	if len(contracts) == 0 {
+		return ids(abis)
+	}
+	found := make([]string, 0)
+	for _, contract := range contracts {
+		scope := abis
+		if attached, ok := abis.contracts[common.HexToAddress(contract).Hex()]; ok {
+			scope = attached
+		}
+		for _, id := range ids(scope) {
+			found = appendId(found, id)
+		}
+	}
+	return found
+}
+
+func (abis *Abis) MethodIds(name string, contracts []string) []string {
+	return abis.lookup(func(scope *Abis) []string { return scope.methods[name] }, contracts)
+}
+
+func (abis *Abis) EventIds(name string, contracts []string) []string {
+	return abis.lookup(func(scope *Abis) []string { return scope.events[name] }, contracts)
+}
+
+// unmarshalAbis reads the abis of the config, either a file or a file attached to the address of a contract
+func unmarshalAbis(raw map[interface{}]interface{}) (map[string]*abiFile, error) {
+	files := make(map[string]*abiFile)
+	tab, ok := raw["abis"].(map[interface{}]interface{})
+	if !ok {
+		return files, nil
+	}
+	for key, value := range tab {
+		label := key.(string)
+		switch value := value.(type) {
+		case string:
+			files[label] = &abiFile{file: value}
+		case map[interface{}]interface{}:
+			file, _ := value["file"].(string)
+			address, _ := value["address"].(string)
+			if len(file) == 0 {
+				return nil, errors.New("Error loading abi " + label + ": missing file")
+			}
+			files[label] = &abiFile{file: file, address: address}
+		default:
+			return nil, errors.New("Error loading abi " + label + ": expecting a file or a file and an address")
+		}
+	}
+	return files, nil
+}
+
+func loadAbis(files map[string]*abiFile, configFile string) (*Abis, error) {
+	abis := NewAbis()
+	for label, abiFile := range files {
+		pathFile := abiFile.file
+		if !filepath.IsAbs(pathFile) {
+			pathFile = filepath.Join(filepath.Dir(configFile), pathFile)
+		}
+		if err := abis.Load(label, pathFile, abiFile.address); err != nil {
+			return nil, err
+		}
+	}
+	return abis, nil
+}
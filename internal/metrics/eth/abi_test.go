@@ -0,0 +1,76 @@
+package eth
+
+import (
+	"fmt"
+	metrics "github.com/IRT-SystemX/bcm-poller/internal/metrics"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	tokenAbi    = `[{"type":"function","name":"approve","inputs":[{"name":"spender","type":"address"},{"name":"value","type":"uint256"}]}]`
+	exchangeAbi = `[{"type":"function","name":"approve","inputs":[{"name":"spender","type":"address"}]},` +
+		`{"type":"event","name":"Swap","inputs":[{"name":"amount","type":"uint256","indexed":false}]}]`
+	exchange = "0x1005388E1649240036d199B6ad71EafC0164edAd"
+)
+
+func TestAbisScopedToContract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "abis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range map[string]string{"erc20.json": tokenAbi, "exchange.json": exchangeAbi} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := `
+abis:
+    my_token: "erc20.json"
+    my_exchange:
+        file: "exchange.json"
+        address: "` + exchange + `"
+events:
+    any_approve:
+        - "method = approve"
+    exchange_approve:
+        - "to = 0x1005388e1649240036d199b6ad71eafc0164edad and method = approve"
+    both_approve:
+        - "to in [0x4592d8f8d7b001e72cb26a73e4fa1806a51ac79d, ` + exchange + `] and method = approve"
+    exchange_swap:
+        - "address = ` + exchange + ` and event = Swap"
+`
+	var raw map[interface{}]interface{}
+	if err := yaml.Unmarshal([]byte(config), &raw); err != nil {
+		t.Fatal(err)
+	}
+	tracking, _, err := parseConfig(raw, filepath.Join(dir, "config.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// approve(address,uint256) of the token and approve(address) of the exchange
+	expected := map[string][]string{
+		"any_approve":      {"0x095ea7b3"},
+		"exchange_approve": {"0xdaea85c5"},
+		"both_approve":     {"0x095ea7b3", "0xdaea85c5"},
+	}
+	for _, event := range tracking.Events {
+		for _, rule := range event.Rules() {
+			if rule.Field != metrics.METHOD {
+				continue
+			}
+			if fmt.Sprint(rule.Values) != fmt.Sprint(expected[event.Label]) {
+				t.Errorf("%s: got %v, want %v", event.Label, rule.Values, expected[event.Label])
+			}
+		}
+	}
+
+	raw["events"] = map[interface{}]interface{}{"any_swap": []interface{}{"event = Swap"}}
+	if _, _, err := parseConfig(raw, filepath.Join(dir, "config.yml")); err == nil {
+		t.Errorf("event of an abi attached to another contract: got no error")
+	}
+}
@@ -4,10 +4,11 @@ import (
 	"context"
 	metrics "github.com/IRT-SystemX/bcm-poller/internal/metrics"
 	poller "github.com/IRT-SystemX/bcm-poller/poller"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"log"
 	"math/big"
+	"strings"
 )
 
 type Miner struct {
@@ -36,46 +37,119 @@ type Tracking struct {
 	Balances []*Balance       `json:"balances"`
 }
 
+// number of reorgs kept on /forks
+const maxForks int = 100
+
 type Cache struct {
 	*metrics.RawCache
-	Tracking *Tracking
-	client   *ethclient.Client
+	Tracking   *Tracking
+	Forks      *metrics.Forks
+	node       Client
+	configFile string
+	abis       *Abis
 	poller.Connector
 }
 
-func NewCache(client *ethclient.Client, configFile string, backupFile string, restore bool, backupFrequency int64) *Cache {
+func NewCache(node Client, configFile string, backupFile string, restore bool, backupFrequency int64) (*Cache, error) {
+	raw, err := metrics.ReadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	tracking, abis, err := parseConfig(raw, configFile)
+	if err != nil {
+		return nil, utils.NewError(utils.ErrConfig, err)
+	}
+	rawCache, err := metrics.NewRawCache(backupFile, restore, backupFrequency)
+	if err != nil {
+		return nil, err
+	}
 	cache := &Cache{
-		RawCache: metrics.NewRawCache(backupFile, restore, backupFrequency),
-		Tracking: parseConfig(configFile),
-		client:   client,
+		RawCache:   rawCache,
+		Tracking:   tracking,
+		node:       node,
+		configFile: configFile,
+		abis:       abis,
+		Forks:      metrics.NewForks(maxForks),
 	}
-	cache.RawCache.Stats["fork"] = metrics.NewStats()
-	raw := cache.LoadBackup()
-	if raw != nil {
-		metrics.UnmarshalTrackingEvents(raw["tracking"].(map[interface{}]interface{})["events"].([]interface{}), cache.Tracking.Events)
-		unmarshalTrackingMiners(raw["tracking"].(map[interface{}]interface{})["miners"].([]interface{}), cache.Tracking.Miners)
+	if _, ok := cache.RawCache.Stats["fork"]; !ok {
+		cache.RawCache.Stats["fork"] = metrics.NewStats()
+	}
+	if err = cache.RawCache.SetWindows(raw); err != nil {
+		return nil, utils.NewError(utils.ErrConfig, err)
+	}
+	distincts := metrics.NewDistincts(&cache.Tracking.Events)
+	cache.RawCache.Backup = map[string]interface{}{"stats": cache.Stats, "tracking": cache.Tracking, "forks": cache.Forks, "distinct": distincts}
+	backup, err := cache.LoadBackup()
+	if err != nil {
+		return nil, err
+	}
+	if backup != nil {
+		metrics.UnmarshalTrackingEvents(backup["tracking"].(map[interface{}]interface{})["events"].([]interface{}), cache.Tracking.Events)
+		distincts.Restore(backup["distinct"])
+		unmarshalTrackingMiners(backup["tracking"].(map[interface{}]interface{})["miners"].([]interface{}), cache.Tracking.Miners)
+		if forks, ok := backup["forks"].([]interface{}); ok {
+			cache.Forks.Restore(forks)
+		}
 	}
-	return cache
+	return cache, nil
 }
 
 func (cache *Cache) SetReady() {
 	cache.RawCache.SetReady()
 }
 
+// balances fetches the balances tracked, out of the lock of the cache
+func (cache *Cache) balances() map[string]string {
+	if !cache.RawCache.Ready() {
+		return nil
+	}
+	cache.RLock()
+	ids := make([]string, 0, len(cache.Tracking.Balances))
+	for _, balance := range cache.Tracking.Balances {
+		ids = append(ids, balance.Id)
+	}
+	cache.RUnlock()
+	balances := make(map[string]string)
+	for _, id := range ids {
+		res, err := cache.node.Client().BalanceAt(context.Background(), common.HexToAddress(id), nil)
+		if err != nil {
+			log.Println("Error: ", err)
+		} else {
+			balances[id] = res.String()
+		}
+	}
+	return balances
+}
+
+// Apply counts the block under the lock of the cache, the balances being fetched before and the observers notified
+// and the backup written after
 func (cache *Cache) Apply(event interface{}) {
 	blockEvent := interface{}(event).(*BlockCacheEvent)
+	balances := cache.balances()
+	cache.Lock()
+	notifications, snapshot := cache.apply(blockEvent, balances)
+	cache.Unlock()
+	cache.Notify(notifications...)
+	cache.Write(snapshot)
+}
+
+func (cache *Cache) apply(blockEvent *BlockCacheEvent, balances map[string]string) ([]*metrics.Notification, *metrics.Snapshot) {
+	metrics.StartEvents(cache.Tracking.Events, blockEvent.Number())
 	cache.Stats["block"].Increment(blockEvent.Timestamp(), blockEvent.Number())
+	notification := metrics.NewNotification(metrics.BLOCK, blockEvent.Number(), blockEvent.Hash(), blockEvent.Timestamp())
+	notification.ParentHash = blockEvent.ParentHash()
+	notifications := []*metrics.Notification{notification}
 	if len(blockEvent.Transactions) > 0 {
-		cache.Stats["transaction"].Update(big.NewInt(int64(len(blockEvent.Transactions))), blockEvent.Timestamp(), blockEvent.Number().String())
+		cache.Stats["transaction"].Update(big.NewInt(int64(len(blockEvent.Transactions))), blockEvent.Timestamp(), blockEvent.Number())
 		for _, tx := range blockEvent.Transactions {
 			for _, event := range cache.Tracking.Events {
-				var check bool = true
-				for _, rule := range event.Rules() {
-					check = check && cache.check(rule, tx)
-				}
-				if check {
+				if cache.match(event, tx) {
 					log.Printf("> detect event %s", event.Label)
-					event.Increment(blockEvent.Timestamp(), blockEvent.Number())
+					event.Apply(blockEvent.Timestamp(), blockEvent.Number(), tx.Sample)
+					notification := metrics.NewNotification(metrics.DETECT, blockEvent.Number(), blockEvent.Hash(), blockEvent.Timestamp())
+					notification.Label = event.Label
+					notification.Data = tx
+					notifications = append(notifications, notification)
 				}
 			}
 		}
@@ -88,36 +162,47 @@ func (cache *Cache) Apply(event interface{}) {
 		if val == blockEvent.Miner {
 			log.Printf("> detect miner %s", miner.Label)
 			miner.Increment(blockEvent.Timestamp(), blockEvent.Number())
+			notification := metrics.NewNotification(metrics.MINER, blockEvent.Number(), blockEvent.Hash(), blockEvent.Timestamp())
+			notification.Label = miner.Label
+			notification.Data = miner.Id
+			notifications = append(notifications, notification)
 		}
 		miner.CurrentBlock = blockEvent.Number().String()
 	}
-	if cache.RawCache.Ready() {
-		for _, balance := range cache.Tracking.Balances {
-			res, err := cache.client.BalanceAt(context.Background(), common.HexToAddress(balance.Id), nil)
-			if err != nil {
-				log.Println("Error: ", err)
-			} else {
-				balance.Balance = res.String()
-			}
+	for _, balance := range cache.Tracking.Balances {
+		if res, ok := balances[balance.Id]; ok && balance.Balance != res {
+			balance.Balance = res
+			notification := metrics.NewNotification(metrics.BALANCE, blockEvent.Number(), blockEvent.Hash(), blockEvent.Timestamp())
+			notification.Label = balance.Label
+			notification.Data = &Balance{Id: balance.Id, Label: balance.Label, Balance: res}
+			notifications = append(notifications, notification)
 		}
 	}
-	cache.RawCache.Save()
+	cache.RawCache.Tick(blockEvent.Timestamp(), blockEvent.Number())
+	for _, event := range cache.Tracking.Events {
+		event.Tick(blockEvent.Timestamp(), blockEvent.Number())
+	}
+	cache.RawCache.ApplyHead(blockEvent.Number(), blockEvent.Hash())
+	return notifications, cache.RawCache.Save()
 }
 
 func (cache *Cache) Revert(event interface{}) {
 	blockEvent := interface{}(event).(*BlockCacheEvent)
-	cache.Stats["block"].Decrement()
+	cache.Lock()
+	cache.revert(blockEvent)
+	cache.Unlock()
+	cache.Notify(metrics.NewNotification(metrics.REVERT, blockEvent.Number(), blockEvent.Hash(), blockEvent.Timestamp()))
+}
+
+func (cache *Cache) revert(blockEvent *BlockCacheEvent) {
+	cache.Stats["block"].Decrement(blockEvent.Number())
 	if len(blockEvent.Transactions) > 0 {
-		cache.Stats["transaction"].Substract(big.NewInt(int64(len(blockEvent.Transactions))))
+		cache.Stats["transaction"].Rollback(big.NewInt(int64(len(blockEvent.Transactions))), blockEvent.Number())
 		for _, tx := range blockEvent.Transactions {
 			for _, event := range cache.Tracking.Events {
-				var check bool = true
-				for _, rule := range event.Rules() {
-					check = check && cache.check(rule, tx)
-				}
-				if check {
+				if cache.match(event, tx) {
 					//log.Printf("> revert event %s", event.Label)
-					event.Decrement()
+					event.Revert(blockEvent.Number(), tx.Sample)
 				}
 			}
 		}
@@ -126,9 +211,30 @@ func (cache *Cache) Revert(event interface{}) {
 		val := common.HexToAddress(miner.Id).Hex()
 		if val == blockEvent.Miner {
 			//log.Printf("> revert miner %s", miner.Label)
-			miner.Decrement()
+			miner.Decrement(blockEvent.Number())
+		}
+	}
+	cache.RawCache.Untick(blockEvent.Number())
+	for _, event := range cache.Tracking.Events {
+		event.Untick(blockEvent.Number())
+	}
+	cache.RawCache.RevertHead(blockEvent.Number(), blockEvent.ParentHash())
+}
+
+// Record keeps the reorg with the number of transactions of the tracked events reverted
+func (cache *Cache) Record(reorg *metrics.Reorg, reverted []EthBlockEvent) {
+	cache.RLock()
+	for _, blockEvent := range reverted {
+		for _, tx := range blockEvent.(*BlockCacheEvent).Transactions {
+			for _, event := range cache.Tracking.Events {
+				if cache.match(event, tx) {
+					reorg.Events[event.Label]++
+				}
+			}
 		}
 	}
+	cache.RUnlock()
+	cache.Forks.Add(reorg)
 }
 
 func unmarshalTrackingMiners(arr []interface{}, miners []*Miner) {
@@ -155,13 +261,26 @@ func unmarshalAddress(raw map[interface{}]interface{}, field string) map[string]
 	return output
 }
 
-func parseConfig(config string) *Tracking {
+func parseConfig(raw map[interface{}]interface{}, config string) (*Tracking, *Abis, error) {
 	tracking := &Tracking{Events: make([]*metrics.Event, 0), Miners: make([]*Miner, 0), Balances: make([]*Balance, 0)}
-	raw := metrics.LoadConfig(config)
+	abis := NewAbis()
 	if raw != nil {
-		events := metrics.UnmarshalEvents(raw, "events")
-		for key, value := range events {
-			tracking.Events = append(tracking.Events, metrics.NewEvent(key, value))
+		files, err := unmarshalAbis(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		if abis, err = loadAbis(files, config); err != nil {
+			return nil, nil, err
+		}
+		events, err := metrics.UnmarshalEvents(raw, "events")
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, event := range events {
+			if err := resolveEvent(event, abis); err != nil {
+				return nil, nil, err
+			}
+			tracking.Events = append(tracking.Events, event)
 		}
 		miners := unmarshalAddress(raw, "miners")
 		for key, value := range miners {
@@ -172,30 +291,121 @@ func parseConfig(config string) *Tracking {
 			tracking.Balances = append(tracking.Balances, &Balance{Id: value, Label: key})
 		}
 	}
-	return tracking
+	return tracking, abis, nil
 }
 
-func (*Cache) check(rule *metrics.EventRule, obj interface{}) bool {
-	tx := obj.(*TxEvent)
+func resolveEvent(event *metrics.Event, abis *Abis) error {
+	for _, rule := range event.Rules() {
+		if err := resolveRule(rule, abis, ruleContracts(event, rule.Field)); err != nil {
+			err.(*metrics.ParseError).Label = event.Label
+			return err
+		}
+	}
+	return nil
+}
+
+// ruleContracts returns the addresses the event is tracked on, the to of a method and the address of an event, to look up
+// their names in the abis attached to these contracts
+func ruleContracts(event *metrics.Event, field metrics.Field) []string {
+	target := metrics.TO
+	if field == metrics.EVENT {
+		target = metrics.ADDRESS
+	} else if field != metrics.METHOD {
+		return nil
+	}
+	addresses := make([]string, 0)
+	for _, rule := range event.Rules() {
+		if rule.Field == target && (rule.Operator == metrics.EQ || rule.Operator == metrics.IN) {
+			addresses = append(addresses, rule.Values...)
+		}
+	}
+	return addresses
+}
+
+func resolveId(value string, lookup func(string, []string) []string, contracts []string, hash func(string) string) []string {
+	if strings.HasPrefix(value, "0x") {
+		return []string{strings.ToLower(value)}
+	}
+	if strings.Contains(value, "(") {
+		return []string{hash(value)}
+	}
+	return lookup(value, contracts)
+}
+
+func resolveRule(rule *metrics.EventRule, abis *Abis, contracts []string) error {
+	values := make([]string, 0, len(rule.Values))
+	for _, value := range rule.Values {
+		switch rule.Field {
+		case metrics.FROM, metrics.TO, metrics.ADDRESS:
+			values = append(values, common.HexToAddress(value).Hex())
+		case metrics.TOPIC:
+			values = append(values, common.HexToHash(value).Hex())
+		case metrics.METHOD:
+			ids := resolveId(value, abis.MethodIds, contracts, utils.GetFunctionId)
+			if len(ids) == 0 {
+				return rule.Error("unknown method " + value)
+			}
+			values = append(values, ids...)
+		case metrics.EVENT:
+			ids := resolveId(value, abis.EventIds, contracts, utils.GetEventId)
+			if len(ids) == 0 {
+				return rule.Error("unknown event " + value)
+			}
+			values = append(values, ids...)
+		default:
+			values = append(values, value)
+		}
+	}
+	rule.Values = values
+	return nil
+}
+
+func isLogRule(rule *metrics.EventRule) bool {
+	return rule.Field == metrics.TOPIC || rule.Field == metrics.EVENT || rule.Field == metrics.ADDRESS
+}
+
+func (cache *Cache) match(event *metrics.Event, tx *TxEvent) bool {
+	var logRules bool = false
+	for _, rule := range event.Rules() {
+		logRules = logRules || isLogRule(rule)
+	}
+	if !logRules || len(tx.Logs) == 0 {
+		return cache.matchLog(event, tx, nil)
+	}
+	for _, vLog := range tx.Logs {
+		if cache.matchLog(event, tx, vLog) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cache *Cache) matchLog(event *metrics.Event, tx *TxEvent, vLog *LogEvent) bool {
+	return event.Match(func(rule *metrics.EventRule) bool {
+		return cache.check(rule, tx, vLog)
+	})
+}
+
+func (*Cache) check(rule *metrics.EventRule, tx *TxEvent, vLog *LogEvent) bool {
 	switch rule.Field {
 	case metrics.FROM:
-		val := common.HexToAddress(rule.Value).Hex()
-		return val == tx.Sender
+		return rule.MatchString(tx.Sender)
 	case metrics.TO:
-		val := common.HexToAddress(rule.Value).Hex()
-		return val == tx.Receiver
+		return rule.MatchString(tx.Receiver)
 	case metrics.VALUE:
-		val, _ := new(big.Int).SetString(rule.Value, 10)
-		switch rule.Operator {
-		case metrics.EQ:
-			return tx.Value.Cmp(val) == 0
-		case metrics.GT:
-			return tx.Value.Cmp(val) >= 0
-		case metrics.LT:
-			return tx.Value.Cmp(val) <= 0
-		}
+		return rule.MatchInt(tx.Value)
+	case metrics.GAS:
+		return rule.MatchInt(new(big.Int).SetUint64(tx.Gas))
 	case metrics.DEPLOY:
 		return tx.Deploy != "0x0000000000000000000000000000000000000000"
+	case metrics.METHOD:
+		return rule.MatchString(tx.FunctionId)
+	case metrics.ADDRESS:
+		return vLog != nil && rule.MatchString(vLog.Address)
+	case metrics.EVENT:
+		return vLog != nil && len(vLog.Topics) > 0 && rule.MatchString(strings.ToLower(vLog.Topics[0]))
+	case metrics.TOPIC:
+		return vLog != nil && rule.MatchAny(vLog.Topics)
 	}
 	return false
 }
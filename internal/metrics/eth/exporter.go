@@ -1,11 +1,13 @@
 package eth
 
 import (
+	"fmt"
 	utils "github.com/IRT-SystemX/bcm-poller/utils"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/prometheus/client_golang/prometheus"
-	"reflect"
+	"log"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,7 +29,7 @@ func NewMeasure(name string, desc string, valueType prometheus.ValueType, value
 		for key, val := range labels {
 			measure.labelsName[i] = key
 			if val != nil {
-				measure.labelsValue[i] = val.(string)
+				measure.labelsValue[i] = fmt.Sprint(val)
 			} else {
 				measure.labelsValue[i] = ""
 			}
@@ -48,79 +50,249 @@ func (measure *Measure) metric() prometheus.Metric {
 type ExporterCache struct {
 	*Cache
 	startTime time.Time
+	mux       sync.Mutex
 	measures  map[string]*Measure
 	Fetcher   *utils.Fetcher
 }
 
-func NewExporterCache(client *ethclient.Client, fetcher *utils.Fetcher, configFile string, backupFile string, restore bool, backupFrequency int64) *ExporterCache {
+func NewExporterCache(node Client, fetcher *utils.Fetcher, configFile string, backupFile string, restore bool, backupFrequency int64) (*ExporterCache, error) {
+	base, err := NewCache(node, configFile, backupFile, restore, backupFrequency)
+	if err != nil {
+		return nil, err
+	}
 	cache := &ExporterCache{
-		Cache:     NewCache(client, configFile, backupFile, restore, backupFrequency),
+		Cache:     base,
 		startTime: time.Now(),
 		measures:  make(map[string]*Measure),
 		Fetcher:   fetcher,
 	}
 	cache.update(nil)
-	return cache
+	return cache, nil
 }
 
-func (cache *ExporterCache) Describe(ch chan<- *prometheus.Desc) {
+// snapshot copies the measures, set by the poller while collected by the scrapes of /metrics
+func (cache *ExporterCache) snapshot() []*Measure {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	measures := make([]*Measure, 0, len(cache.measures))
 	for _, val := range cache.measures {
+		measures = append(measures, val)
+	}
+	return measures
+}
+
+func (cache *ExporterCache) Describe(ch chan<- *prometheus.Desc) {
+	for _, val := range cache.snapshot() {
 		ch <- val.desc()
 	}
 }
 
 func (cache *ExporterCache) Collect(ch chan<- prometheus.Metric) {
-	for _, val := range cache.measures {
+	for _, val := range cache.snapshot() {
 		ch <- val.metric()
 	}
 }
 
 func (cache *ExporterCache) set(name string, desc string, valueType prometheus.ValueType, value float64, labels map[string]interface{}) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
 	cache.measures[name] = NewMeasure(name, desc, valueType, value, labels)
 }
 
-func (cache *ExporterCache) updateInfos() {
-	version := cache.Fetcher.Get("parity_versionInfo").(map[string]interface{})
-	version_num := version["version"].(map[string]interface{})
+// replace swaps the measures of the prefix for the new ones at once, dropping what is not tracked anymore
+func (cache *ExporterCache) replace(prefix string, measures map[string]*Measure) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	for name := range cache.measures {
+		if strings.HasPrefix(name, prefix) {
+			delete(cache.measures, name)
+		}
+	}
+	for name, measure := range measures {
+		cache.measures[name] = measure
+	}
+}
+
+// fetch calls the methods of the api, stopping at the first error
+func (cache *ExporterCache) fetch(methods ...string) (map[string]interface{}, error) {
+	results := make(map[string]interface{})
+	for _, method := range methods {
+		result, err := cache.Fetcher.Get(method)
+		if err != nil {
+			return nil, err
+		}
+		results[method] = result
+	}
+	return results, nil
+}
+
+func (cache *ExporterCache) updateInfos() error {
+	res, err := cache.fetch("parity_versionInfo", "parity_chain", "parity_enode", "parity_nodeName", "web3_clientVersion", "eth_coinbase", "eth_mining", "net_listening", "net_peerCount")
+	if err != nil {
+		return err
+	}
+	version, err := decodeMap("parity_versionInfo", res["parity_versionInfo"])
+	if err != nil {
+		return err
+	}
+	versionNum, err := decodeMap("parity_versionInfo.version", version["version"])
+	if err != nil {
+		return err
+	}
+	numbers := make([]string, 0, 3)
+	for _, key := range []string{"major", "minor", "patch"} {
+		number, err := decodeNumber("parity_versionInfo.version."+key, versionNum[key])
+		if err != nil {
+			return err
+		}
+		numbers = append(numbers, utils.FloatToString(number))
+	}
+	hash, err := decodeString("parity_versionInfo.hash", version["hash"])
+	if err != nil {
+		return err
+	}
+	mining, err := decodeBool("eth_mining", res["eth_mining"])
+	if err != nil {
+		return err
+	}
+	listening, err := decodeBool("net_listening", res["net_listening"])
+	if err != nil {
+		return err
+	}
 	labels := map[string]interface{}{
-		"parity_chain_name":   cache.Fetcher.Get("parity_chain"),
-		"parity_enode":        cache.Fetcher.Get("parity_enode"),
-		"parity_node_name":    cache.Fetcher.Get("parity_nodeName"),
-		"parity_version":      utils.FloatToString(version_num["major"].(float64)) + "." + utils.FloatToString(version_num["minor"].(float64)) + "." + utils.FloatToString(version_num["patch"].(float64)),
-		"parity_version_hash": version["hash"].(string),
-		"web3_version":        cache.Fetcher.Get("web3_clientVersion"),
-		"eth_coinbase":        cache.Fetcher.Get("eth_coinbase"),
-		"is_mining":           strconv.FormatBool(cache.Fetcher.Get("eth_mining").(bool)),
-		"is_listening":        strconv.FormatBool(cache.Fetcher.Get("net_listening").(bool)),
-		"net_peerCount":       cache.Fetcher.Get("net_peerCount"),
+		"parity_chain_name":   res["parity_chain"],
+		"parity_enode":        res["parity_enode"],
+		"parity_node_name":    res["parity_nodeName"],
+		"parity_version":      strings.Join(numbers, "."),
+		"parity_version_hash": hash,
+		"web3_version":        fmt.Sprint(res["web3_clientVersion"]),
+		"eth_coinbase":        res["eth_coinbase"],
+		"is_mining":           strconv.FormatBool(mining),
+		"is_listening":        strconv.FormatBool(listening),
+		"net_peerCount":       res["net_peerCount"],
 		"poller_uptime":       utils.IntToString(int64(time.Now().Sub(cache.startTime).Seconds())),
 	}
 	cache.set("parity_node_info", "infos", prometheus.CounterValue, 1, labels)
+	return nil
+}
+
+func decodeError(name string, kind string, val interface{}) error {
+	return utils.NewError(utils.ErrDecode, fmt.Errorf("%s: expecting %s, got %v", name, kind, val))
+}
+
+func decodeMap(name string, val interface{}) (map[string]interface{}, error) {
+	res, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, decodeError(name, "an object", val)
+	}
+	return res, nil
+}
+
+func decodeString(name string, val interface{}) (string, error) {
+	res, ok := val.(string)
+	if !ok {
+		return "", decodeError(name, "a string", val)
+	}
+	return res, nil
+}
+
+func decodeBool(name string, val interface{}) (bool, error) {
+	res, ok := val.(bool)
+	if !ok {
+		return false, decodeError(name, "a boolean", val)
+	}
+	return res, nil
+}
+
+func decodeNumber(name string, val interface{}) (float64, error) {
+	res, ok := val.(float64)
+	if !ok {
+		return 0, decodeError(name, "a number", val)
+	}
+	return res, nil
 }
 
-func (cache *ExporterCache) updateFromApi() {
-	cache.set("eth_gas_price", "gas_price", prometheus.GaugeValue, utils.StringToFloat(utils.Decode(cache.Fetcher.Get("eth_gasPrice").(string)).String()), nil)
-	cache.set("eth_hashrate", "hashrate", prometheus.GaugeValue, utils.StringToFloat(utils.Decode(cache.Fetcher.Get("eth_hashrate").(string)).String()), nil)
-	cache.set("parity_pendingTransactions", "pending", prometheus.GaugeValue, float64(len(cache.Fetcher.Get("parity_pendingTransactions").([]interface{}))), map[string]interface{}{
-		"node_pending_transactions_limit": utils.FloatToString(cache.Fetcher.Get("parity_transactionsLimit").(float64)),
+// decode parses an hex quantity of the api
+func decode(val interface{}) (float64, error) {
+	str, ok := val.(string)
+	if !ok {
+		return 0, utils.NewError(utils.ErrDecode, fmt.Errorf("expecting an hex string, got %v", val))
+	}
+	number, err := utils.Decode(str)
+	if err != nil {
+		return 0, err
+	}
+	return utils.StringToFloat(number.String())
+}
+
+func (cache *ExporterCache) updateFromApi() error {
+	res, err := cache.fetch("eth_gasPrice", "eth_hashrate", "parity_pendingTransactions", "parity_transactionsLimit", "eth_syncing", "parity_netPeers")
+	if err != nil {
+		return err
+	}
+	gasPrice, err := decode(res["eth_gasPrice"])
+	if err != nil {
+		return err
+	}
+	hashrate, err := decode(res["eth_hashrate"])
+	if err != nil {
+		return err
+	}
+	pending, ok := res["parity_pendingTransactions"].([]interface{})
+	if !ok {
+		return decodeError("parity_pendingTransactions", "a list", res["parity_pendingTransactions"])
+	}
+	limit, err := decodeNumber("parity_transactionsLimit", res["parity_transactionsLimit"])
+	if err != nil {
+		return err
+	}
+	peers, err := decodeMap("parity_netPeers", res["parity_netPeers"])
+	if err != nil {
+		return err
+	}
+	connected, err := decodeNumber("parity_netPeers.connected", peers["connected"])
+	if err != nil {
+		return err
+	}
+	max, err := decodeNumber("parity_netPeers.max", peers["max"])
+	if err != nil {
+		return err
+	}
+	cache.set("eth_gas_price", "gas_price", prometheus.GaugeValue, gasPrice, nil)
+	cache.set("eth_hashrate", "hashrate", prometheus.GaugeValue, hashrate, nil)
+	cache.set("parity_pendingTransactions", "pending", prometheus.GaugeValue, float64(len(pending)), map[string]interface{}{
+		"node_pending_transactions_limit": utils.FloatToString(limit),
 	})
-	syncing := cache.Fetcher.Get("eth_syncing")
-	if reflect.TypeOf(syncing).Name() == "bool" {
+	switch syncing := res["eth_syncing"].(type) {
+	case bool:
 		cache.set("eth_syncing", "sync", prometheus.GaugeValue, 1, map[string]interface{}{
 			"eth_sync_starting": nil,
 			"eth_sync_highest":  nil,
 		})
-	} else {
-		syncingMap := syncing.(map[string]interface{})
-		cache.set("eth_syncing", "sync", prometheus.GaugeValue, utils.StringToFloat(utils.Decode(syncingMap["currentBlock"].(string)).String()), map[string]interface{}{
-			"eth_sync_starting": syncingMap["startingBlock"].(string),
-			"eth_sync_highest":  syncingMap["highestBlock"].(string),
+	case map[string]interface{}:
+		currentBlock, err := decode(syncing["currentBlock"])
+		if err != nil {
+			return err
+		}
+		starting, err := decodeString("eth_syncing.startingBlock", syncing["startingBlock"])
+		if err != nil {
+			return err
+		}
+		highest, err := decodeString("eth_syncing.highestBlock", syncing["highestBlock"])
+		if err != nil {
+			return err
+		}
+		cache.set("eth_syncing", "sync", prometheus.GaugeValue, currentBlock, map[string]interface{}{
+			"eth_sync_starting": starting,
+			"eth_sync_highest":  highest,
 		})
+	default:
+		return decodeError("eth_syncing", "a boolean or an object", syncing)
 	}
-	peers := cache.Fetcher.Get("parity_netPeers").(map[string]interface{})
-	cache.set("parity_node_peers", "peers", prometheus.GaugeValue, peers["connected"].(float64), map[string]interface{}{
-		"peers_max": utils.FloatToString(peers["max"].(float64)),
+	cache.set("parity_node_peers", "peers", prometheus.GaugeValue, connected, map[string]interface{}{
+		"peers_max": utils.FloatToString(max),
 	})
+	return nil
 }
 
 func (cache *ExporterCache) updateFromBlock(event interface{}) {
@@ -151,24 +323,48 @@ func (cache *ExporterCache) updateFromBlock(event interface{}) {
 }
 
 func (cache *ExporterCache) updateFromCache() {
+	cache.RLock()
+	defer cache.RUnlock()
 	cache.set("poller_block_interval", "block_interval", prometheus.GaugeValue, float64(cache.Stats["block"].Interval), nil)
 	cache.set("poller_transaction_interval", "transaction_interval", prometheus.GaugeValue, float64(cache.Stats["transaction"].Interval), nil)
 	cache.set("poller_fork", "fork", prometheus.GaugeValue, float64(cache.Stats["fork"].Interval), nil)
+	tracking := make(map[string]*Measure)
+	track := func(name string, desc string, value float64) {
+		tracking["poller_tracking_"+name] = NewMeasure("poller_tracking_"+name, desc, prometheus.GaugeValue, value, nil)
+	}
 	for _, event := range cache.Tracking.Events {
-		cache.set("poller_tracking_events_"+event.Label, "events", prometheus.GaugeValue, float64(event.Stats.Interval), nil)
+		track("events_"+event.Label, "events", float64(event.Stats.Interval))
+		for _, aggregate := range event.Aggregates {
+			value, err := utils.StringToFloat(aggregate.Value)
+			if err != nil {
+				log.Printf("Error aggregate %s: %v", event.Label, err)
+				continue
+			}
+			track("events_"+event.Label+"_"+string(aggregate.Function())+"_"+string(aggregate.Field()), "aggregates", value)
+		}
 	}
 	for _, event := range cache.Tracking.Miners {
-		cache.set("poller_tracking_miners_"+event.Label, "miners", prometheus.GaugeValue, float64(event.Stats.Interval), nil)
+		track("miners_"+event.Label, "miners", float64(event.Stats.Interval))
 	}
 	for _, event := range cache.Tracking.Balances {
-		cache.set("poller_tracking_balances_"+event.Label, "balances", prometheus.GaugeValue, utils.StringToFloat(event.Balance), nil)
+		value, err := utils.StringToFloat(event.Balance)
+		if err != nil {
+			log.Printf("Error balance %s: %v", event.Label, err)
+			continue
+		}
+		track("balances_"+event.Label, "balances", value)
 	}
+	cache.replace("poller_tracking_", tracking)
 }
 
 func (cache *ExporterCache) update(event interface{}) {
 	if cache.Fetcher != nil {
-		cache.updateInfos()
-		cache.updateFromApi()
+		if err := cache.updateInfos(); err != nil {
+			log.Println("Error api: ", err)
+		}
+		if err := cache.updateFromApi(); err != nil {
+			log.Println("Error api: ", err)
+		}
 		cache.updateFromBlock(event)
 		cache.updateFromCache()
 	}
@@ -2,8 +2,10 @@ package eth
 
 import (
 	"container/list"
+	metrics "github.com/IRT-SystemX/bcm-poller/internal/metrics"
 	poller "github.com/IRT-SystemX/bcm-poller/poller"
 	"log"
+	"math/big"
 	"reflect"
 )
 
@@ -11,17 +13,49 @@ type EthBlockEvent interface {
 	poller.BlockEvent
 	ParentHash() string
 	Hash() string
+	Timestamp() uint64
 	SetFork(bool)
 }
 
+var one = big.NewInt(1)
+
+// Node fetches a block by hash, canonical or orphaned by a reorg
+type Node interface {
+	BlockByHash(hash string) (EthBlockEvent, error)
+}
+
+// History gives the hash of the blocks applied before the chain of the watcher, empty if unknown
+type History interface {
+	Hash(number *big.Int) (string, error)
+}
+
+// Recorder keeps the reorgs detected by the watcher, with the blocks reverted
+type Recorder interface {
+	Record(reorg *metrics.Reorg, reverted []EthBlockEvent)
+}
+
 type ForkWatcher struct {
 	connector   poller.Connector
+	node        Node
+	history     History
+	recorder    Recorder
+	floor       *big.Int
 	maxForkSize int
 	chain       *list.List
 }
 
 func NewForkWatcher(connector poller.Connector, maxForkSize int) *ForkWatcher {
-	return &ForkWatcher{connector: connector, maxForkSize: maxForkSize, chain: list.New()}
+	return &ForkWatcher{connector: connector, maxForkSize: maxForkSize, chain: list.New(), floor: big.NewInt(0)}
+}
+
+// SetHistory walks back a reorg deeper than the chain of the watcher over the blocks of the history from floor
+func (fork *ForkWatcher) SetHistory(history History, floor *big.Int) {
+	fork.history = history
+	fork.floor = floor
+}
+
+func (fork *ForkWatcher) SetRecorder(recorder Recorder) {
+	fork.recorder = recorder
 }
 
 func (fork *ForkWatcher) last() EthBlockEvent {
@@ -39,41 +73,118 @@ func (fork *ForkWatcher) apply(blockEvent EthBlockEvent) {
 	fork.chain.PushBack(blockEvent)
 }
 
-func (fork *ForkWatcher) revert(elem *list.Element) {
+func (fork *ForkWatcher) revert(elem *list.Element) EthBlockEvent {
 	if fork.chain.Len() > 0 {
 		fork.chain.Remove(elem)
 	}
 	if fork.connector != nil && !reflect.ValueOf(fork.connector).IsNil() {
 		fork.connector.Revert(elem.Value.(EthBlockEvent))
 	}
+	return elem.Value.(EthBlockEvent)
+}
+
+// hash returns the hash of the block applied at this number, from the chain of the watcher or else from the history
+func (fork *ForkWatcher) hash(number *big.Int) (string, *list.Element) {
+	for elem := fork.chain.Back(); elem != nil; elem = elem.Prev() {
+		if elem.Value.(EthBlockEvent).Number().Cmp(number) == 0 {
+			return elem.Value.(EthBlockEvent).Hash(), elem
+		}
+	}
+	if fork.history == nil || number.Cmp(fork.floor) < 0 {
+		return "", nil
+	}
+	hash, err := fork.history.Hash(number)
+	if err != nil {
+		log.Println("Error history: ", err)
+	}
+	return hash, nil
+}
+
+// revertHistory reverts a block older than the chain of the watcher, fetched by hash from the node
+func (fork *ForkWatcher) revertHistory(number *big.Int, hash string) EthBlockEvent {
+	blockEvent, err := fork.node.BlockByHash(hash)
+	if err != nil {
+		log.Printf("Error orphaned block #%s %s: %v", number.String(), hash, err)
+		return nil
+	}
+	if fork.connector != nil && !reflect.ValueOf(fork.connector).IsNil() {
+		fork.connector.Revert(blockEvent)
+	}
+	return blockEvent
+}
+
+func (fork *ForkWatcher) replace(blockEvent EthBlockEvent) {
+	fork.apply(blockEvent)
+	if fork.connector != nil && !reflect.ValueOf(fork.connector).IsNil() {
+		fork.connector.Apply(blockEvent)
+	}
 }
 
-func (fork *ForkWatcher) checkFork(blockEvent EthBlockEvent) {
-	if fork.last() != nil {
-		if fork.last().Hash() != blockEvent.ParentHash() {
-			blockEvent.SetFork(true)
-			if fork.last().Hash() == blockEvent.Hash() {
-				//log.Printf("Detect block update")
-				fork.revert(fork.chain.Back())
-			} else {
-				//log.Printf("Detect fork block %s != %s", blockEvent.ParentHash, fork.last().Hash)
-				//log.Printf("Detect fork block #%s != #%s", blockEvent.Number, fork.last().Number)
-				if blockEvent.Number().Cmp(fork.last().Number()) <= 0 {
-					//log.Printf("Number <= Last")
-					toRevert := list.New()
-					for elem := fork.chain.Back(); elem != nil && blockEvent.Number().Cmp(elem.Value.(EthBlockEvent).Number()) <= 0; elem = elem.Prev() {
-						toRevert.PushBack(elem)
-					}
-					for elem := toRevert.Front(); elem != nil; elem = elem.Next() {
-						fork.revert(elem.Value.(*list.Element))
-					}
-				} else {
-					//log.Printf("Number > Last")
-					//fork.debugChain()
-				}
+// checkFork reverts the blocks replaced by the new block, walking back its parents from the node until the common ancestor
+// when the reorg is deeper than the chain of the watcher, and applies the parents of the canonical branch: it returns
+// true for a block of the chain processed again with the same hash, which is not a reorg
+func (fork *ForkWatcher) checkFork(blockEvent EthBlockEvent) bool {
+	last := fork.last()
+	if last == nil || last.Hash() == blockEvent.ParentHash() || blockEvent.Number().Cmp(new(big.Int).Add(last.Number(), one)) > 0 {
+		return false
+	}
+	if _, elem := fork.hash(blockEvent.Number()); elem != nil && elem.Value.(EthBlockEvent).Hash() == blockEvent.Hash() {
+		return true
+	}
+	blockEvent.SetFork(true)
+	reverted := make([]EthBlockEvent, 0)
+	for fork.last() != nil && fork.last().Number().Cmp(blockEvent.Number()) >= 0 {
+		reverted = append(reverted, fork.revert(fork.chain.Back()))
+	}
+	number := new(big.Int).Sub(blockEvent.Number(), one)
+	parentHash := blockEvent.ParentHash()
+	canonical := list.New()
+	for {
+		hash, elem := fork.hash(number)
+		if hash == parentHash {
+			break
+		}
+		if len(hash) == 0 {
+			log.Printf("Reorg deeper than the known blocks, no common ancestor from block #%s", number.String())
+			break
+		}
+		if elem != nil {
+			reverted = append(reverted, fork.revert(elem))
+		} else if fork.node != nil {
+			if orphan := fork.revertHistory(number, hash); orphan != nil {
+				reverted = append(reverted, orphan)
 			}
 		}
+		if fork.node == nil {
+			log.Printf("Reorg deeper than %d blocks, no node to walk back from block #%s", fork.maxForkSize, number.String())
+			break
+		}
+		parent, err := fork.node.BlockByHash(parentHash)
+		if err != nil {
+			log.Printf("Error canonical block #%s %s: %v", number.String(), parentHash, err)
+			break
+		}
+		canonical.PushFront(parent)
+		parentHash = parent.ParentHash()
+		number = new(big.Int).Sub(number, one)
+	}
+	if canonical.Len() > 0 {
+		log.Printf("Reorg of %d blocks from block #%s", canonical.Len()+1, new(big.Int).Add(number, one).String())
+	}
+	reorg := metrics.NewReorg(new(big.Int).Add(number, one).String(), blockEvent.Timestamp())
+	for elem := canonical.Front(); elem != nil; elem = elem.Next() {
+		fork.replace(elem.Value.(EthBlockEvent))
+		reorg.Replaced = append(reorg.Replaced, elem.Value.(EthBlockEvent).Hash())
+	}
+	reorg.Replaced = append(reorg.Replaced, blockEvent.Hash())
+	for i := len(reverted) - 1; i >= 0; i-- {
+		reorg.Reverted = append(reorg.Reverted, reverted[i].Hash())
+	}
+	reorg.Depth = len(reverted)
+	if fork.recorder != nil {
+		fork.recorder.Record(reorg, reverted)
 	}
+	return false
 }
 
 func (fork *ForkWatcher) debugChain() {
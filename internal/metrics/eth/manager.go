@@ -0,0 +1,178 @@
+package eth
+
+import (
+	"errors"
+	metrics "github.com/IRT-SystemX/bcm-poller/internal/metrics"
+	"github.com/ethereum/go-ethereum/common"
+	"log"
+	"math/big"
+)
+
+func (cache *Cache) findEvent(label string) int {
+	for i, event := range cache.Tracking.Events {
+		if event.Label == label {
+			return i
+		}
+	}
+	return -1
+}
+
+func (cache *Cache) AddEvent(label string, raw interface{}) error {
+	event, err := metrics.UnmarshalEvent(label, raw)
+	if err != nil {
+		return err
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.findEvent(label) >= 0 {
+		return metrics.ErrDuplicate
+	}
+	if err = resolveEvent(event, cache.abis); err != nil {
+		return err
+	}
+	event.SetOrigin(cache.Origin())
+	cache.Tracking.Events = append(cache.Tracking.Events, event)
+	log.Printf("Tracking event %s from block #%s", label, event.Origin())
+	return nil
+}
+
+func (cache *Cache) RemoveEvent(label string) error {
+	cache.Lock()
+	defer cache.Unlock()
+	i := cache.findEvent(label)
+	if i < 0 {
+		return metrics.ErrUnknown
+	}
+	cache.Tracking.Events = append(cache.Tracking.Events[:i], cache.Tracking.Events[i+1:]...)
+	log.Printf("Untracking event %s", label)
+	return nil
+}
+
+func (cache *Cache) AddAddress(kind string, label string, id string) error {
+	if !common.IsHexAddress(id) {
+		return errors.New("invalid address " + id)
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	switch kind {
+	case metrics.MINERS:
+		for _, miner := range cache.Tracking.Miners {
+			if miner.Label == label {
+				return metrics.ErrDuplicate
+			}
+		}
+		cache.Tracking.Miners = append(cache.Tracking.Miners, NewMiner(label, id))
+	case metrics.BALANCES:
+		for _, balance := range cache.Tracking.Balances {
+			if balance.Label == label {
+				return metrics.ErrDuplicate
+			}
+		}
+		cache.Tracking.Balances = append(cache.Tracking.Balances, &Balance{Id: id, Label: label})
+	default:
+		return metrics.ErrUnsupported
+	}
+	log.Printf("Tracking %s %s", kind, label)
+	return nil
+}
+
+func (cache *Cache) RemoveAddress(kind string, label string) error {
+	cache.Lock()
+	defer cache.Unlock()
+	switch kind {
+	case metrics.MINERS:
+		for i, miner := range cache.Tracking.Miners {
+			if miner.Label == label {
+				cache.Tracking.Miners = append(cache.Tracking.Miners[:i], cache.Tracking.Miners[i+1:]...)
+				log.Printf("Untracking %s %s", kind, label)
+				return nil
+			}
+		}
+	case metrics.BALANCES:
+		for i, balance := range cache.Tracking.Balances {
+			if balance.Label == label {
+				cache.Tracking.Balances = append(cache.Tracking.Balances[:i], cache.Tracking.Balances[i+1:]...)
+				log.Printf("Untracking %s %s", kind, label)
+				return nil
+			}
+		}
+	default:
+		return metrics.ErrUnsupported
+	}
+	return metrics.ErrUnknown
+}
+
+// Reload applies the configuration file again, keeping the counters of what is still tracked
+func (cache *Cache) Reload() error {
+	raw, err := metrics.ReadConfig(cache.configFile)
+	if err != nil {
+		return err
+	}
+	tracking, abis, err := parseConfig(raw, cache.configFile)
+	if err != nil {
+		return err
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	cache.abis = abis
+	cache.Tracking.Events = metrics.MergeEvents(cache.Tracking.Events, tracking.Events, cache.Origin())
+	for i, miner := range tracking.Miners {
+		for _, x := range cache.Tracking.Miners {
+			if x.Label == miner.Label && x.Id == miner.Id {
+				tracking.Miners[i] = x
+			}
+		}
+	}
+	cache.Tracking.Miners = tracking.Miners
+	for i, balance := range tracking.Balances {
+		for _, x := range cache.Tracking.Balances {
+			if x.Label == balance.Label && x.Id == balance.Id {
+				tracking.Balances[i] = x
+			}
+		}
+	}
+	cache.Tracking.Balances = tracking.Balances
+	log.Printf("Reloaded %s: %d events, %d miners, %d balances", cache.configFile, len(cache.Tracking.Events), len(cache.Tracking.Miners), len(cache.Tracking.Balances))
+	return nil
+}
+
+func (cache *Cache) Tracked(label string) bool {
+	cache.RLock()
+	defer cache.RUnlock()
+	return cache.findEvent(label) >= 0
+}
+
+// SetOrigin starts the events which were not restored from the backup at the first synced block
+func (cache *Cache) SetOrigin(number *big.Int) {
+	cache.Lock()
+	defer cache.Unlock()
+	for _, event := range cache.Tracking.Events {
+		if event.Origin() == nil {
+			event.SetOrigin(number)
+		}
+	}
+}
+
+// Backfill counts the transactions of a past block for the given events which did not count it yet
+func (cache *Cache) Backfill(event interface{}, labels []string) {
+	blockEvent := interface{}(event).(*BlockCacheEvent)
+	cache.Lock()
+	defer cache.Unlock()
+	for _, label := range labels {
+		i := cache.findEvent(label)
+		if i < 0 {
+			continue
+		}
+		event := cache.Tracking.Events[i]
+		if event.Covered(blockEvent.Number()) {
+			continue
+		}
+		for _, tx := range blockEvent.Transactions {
+			if cache.match(event, tx) {
+				log.Printf("> backfill event %s", event.Label)
+				event.Merge(tx.Sample)
+			}
+		}
+		event.Cover(blockEvent.Number())
+	}
+}
@@ -2,13 +2,17 @@ package eth
 
 import (
 	"context"
+	metrics "github.com/IRT-SystemX/bcm-poller/internal/metrics"
 	poller "github.com/IRT-SystemX/bcm-poller/poller"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"log"
 	"math"
 	"math/big"
+	"strconv"
 )
 
 type BlockCacheEvent struct {
@@ -49,29 +53,75 @@ func (blockEvent *BlockCacheEvent) SetFork(fork bool) {
 	blockEvent.Fork = fork
 }
 
+func (blockEvent *BlockCacheEvent) Txs() []interface{} {
+	txs := make([]interface{}, len(blockEvent.Transactions))
+	for i, tx := range blockEvent.Transactions {
+		txs[i] = tx
+	}
+	return txs
+}
+
+type LogEvent struct {
+	Address string   `json:"address"`
+	Topics  []string `json:"topics"`
+}
+
 type TxEvent struct {
-	Sender     string
-	Receiver   string
-	Value      *big.Int
-	FunctionId string
-	Events     []string
-	Deploy     string
+	Hash       string      `json:"hash"`
+	Sender     string      `json:"from"`
+	Receiver   string      `json:"to"`
+	Value      *big.Int    `json:"value"`
+	FunctionId string      `json:"method"`
+	Events     []string    `json:"-"`
+	Logs       []*LogEvent `json:"logs"`
+	Deploy     string      `json:"deploy"`
+	Gas        uint64      `json:"gas"`
+}
+
+func (tx *TxEvent) Sample(field metrics.Field) string {
+	switch field {
+	case metrics.FROM:
+		return tx.Sender
+	case metrics.TO:
+		return tx.Receiver
+	case metrics.VALUE:
+		return tx.Value.String()
+	case metrics.GAS:
+		return strconv.FormatUint(tx.Gas, 10)
+	case metrics.METHOD:
+		return tx.FunctionId
+	}
+	return ""
+}
+
+// Client gives the client of the node in use, which changes on a failover
+type Client interface {
+	Client() *ethclient.Client
+}
+
+// NodeBlock is a block with the client of the node it was fetched from, its receipts being fetched from the same node
+type NodeBlock interface {
+	Block() *types.Block
+	Client() *ethclient.Client
 }
 
 type Processor struct {
-	client *ethclient.Client
+	node   Client
 	signer types.EIP155Signer
 	fork   *ForkWatcher
 }
 
-func NewProcessor(client *ethclient.Client, fork *ForkWatcher) *Processor {
-	processor := &Processor{client: client, fork: fork}
-	chainID, err := processor.client.NetworkID(context.Background())
+func NewProcessor(node Client, fork *ForkWatcher) (*Processor, error) {
+	processor := &Processor{node: node, fork: fork}
+	if fork != nil {
+		fork.node = processor
+	}
+	chainID, err := processor.node.Client().NetworkID(context.Background())
 	if err != nil {
-		log.Fatal(err)
+		return nil, utils.NewError(utils.ErrRPC, err)
 	}
 	processor.signer = types.NewEIP155Signer(chainID)
-	return processor
+	return processor, nil
 }
 
 func (processor *Processor) NewBlockEvent(number *big.Int, parentHash string, hash string) poller.BlockEvent {
@@ -83,8 +133,29 @@ func (processor *Processor) NewBlockEvent(number *big.Int, parentHash string, ha
 	return interface{}(blockEvent).(poller.BlockEvent)
 }
 
-func (processor *Processor) Process(obj interface{}, event poller.BlockEvent, listening bool) {
-	block := obj.(*types.Block)
+// BlockByHash fetches and processes a block out of the sync, to walk back a reorg
+func (processor *Processor) BlockByHash(hash string) (EthBlockEvent, error) {
+	client := processor.node.Client()
+	block, err := client.BlockByHash(context.Background(), common.HexToHash(hash))
+	if err != nil {
+		return nil, utils.NewError(utils.ErrRPC, err)
+	}
+	blockEvent := interface{}(processor.NewBlockEvent(block.Number(), block.ParentHash().Hex(), hash)).(*BlockCacheEvent)
+	if err = processor.process(client, block, blockEvent, false); err != nil {
+		return nil, err
+	}
+	return blockEvent, nil
+}
+
+// Process fetches the receipts of a NodeBlock from its node, and of a block from the node in use
+func (processor *Processor) Process(obj interface{}, event poller.BlockEvent, listening bool) error {
+	if nodeBlock, ok := obj.(NodeBlock); ok {
+		return processor.process(nodeBlock.Client(), nodeBlock.Block(), event, listening)
+	}
+	return processor.process(processor.node.Client(), obj.(*types.Block), event, listening)
+}
+
+func (processor *Processor) process(client *ethclient.Client, block *types.Block, event poller.BlockEvent, listening bool) error {
 	blockEvent := interface{}(event).(*BlockCacheEvent)
 	blockEvent.timestamp = block.Time()
 	blockEvent.difficulty = block.Difficulty().String()
@@ -97,7 +168,7 @@ func (processor *Processor) Process(obj interface{}, event poller.BlockEvent, li
 	blockEvent.Transactions = make([]*TxEvent, len(block.Transactions()))
 	for i, tx := range block.Transactions() {
 		//log.Printf("Process tx %s", tx.Hash().Hex())
-		txEvent := &TxEvent{Events: make([]string, 0)}
+		txEvent := &TxEvent{Hash: tx.Hash().Hex(), Events: make([]string, 0), Logs: make([]*LogEvent, 0)}
 		blockEvent.Transactions[i] = txEvent
 		txEvent.Value = tx.Value()
 		if tx.To() != nil {
@@ -109,25 +180,31 @@ func (processor *Processor) Process(obj interface{}, event poller.BlockEvent, li
 		} else {
 			txEvent.Sender = msg.From().Hex()
 			data := msg.Data()
-			if len(data) > 4 {
+			if len(data) >= 4 {
 				txEvent.FunctionId = string(hexutil.Encode(data[:4]))
 			}
 		}
-		receipt, err := processor.client.TransactionReceipt(context.Background(), tx.Hash())
+		receipt, err := client.TransactionReceipt(context.Background(), tx.Hash())
 		if err != nil {
-			log.Println("Error receipt: ", err)
-		} else {
-			txEvent.Deploy = receipt.ContractAddress.Hex()
-			for _, vLog := range receipt.Logs {
-				for i := range vLog.Topics {
-					txEvent.Events = append(txEvent.Events, vLog.Topics[i].Hex())
-				}
+			return utils.NewError(utils.ErrRPC, err)
+		}
+		txEvent.Deploy = receipt.ContractAddress.Hex()
+		txEvent.Gas = receipt.GasUsed
+		for _, vLog := range receipt.Logs {
+			logEvent := &LogEvent{Address: vLog.Address.Hex(), Topics: make([]string, len(vLog.Topics))}
+			for i := range vLog.Topics {
+				txEvent.Events = append(txEvent.Events, vLog.Topics[i].Hex())
+				logEvent.Topics[i] = vLog.Topics[i].Hex()
 			}
+			txEvent.Logs = append(txEvent.Logs, logEvent)
 		}
 	}
 	blockEvent.SetFork(false)
 	if listening {
-		processor.fork.checkFork(blockEvent)
+		if processor.fork.checkFork(blockEvent) {
+			return poller.ErrKnown
+		}
 		processor.fork.apply(blockEvent)
 	}
+	return nil
 }
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Reorg is a reorganisation detected by the fork watcher
+type Reorg struct {
+	Number    string         `json:"block"`
+	Depth     int            `json:"depth"`
+	Reverted  []string       `json:"reverted"`
+	Replaced  []string       `json:"replaced"`
+	Events    map[string]int `json:"events,omitempty"`
+	Timestamp uint64         `json:"timestamp"`
+	Detected  int64          `json:"detected"`
+}
+
+func NewReorg(number string, timestamp uint64) *Reorg {
+	return &Reorg{Number: number, Reverted: make([]string, 0), Replaced: make([]string, 0), Events: make(map[string]int), Timestamp: timestamp, Detected: time.Now().Unix()}
+}
+
+// Forks keeps the last reorgs, the oldest being dropped beyond the size
+type Forks struct {
+	mux    sync.RWMutex
+	size   int
+	reorgs []*Reorg
+}
+
+func NewForks(size int) *Forks {
+	return &Forks{size: size, reorgs: make([]*Reorg, 0)}
+}
+
+func (forks *Forks) Add(reorg *Reorg) {
+	forks.mux.Lock()
+	defer forks.mux.Unlock()
+	if len(forks.reorgs) >= forks.size {
+		forks.reorgs = forks.reorgs[len(forks.reorgs)-forks.size+1:]
+	}
+	forks.reorgs = append(forks.reorgs, reorg)
+}
+
+func (forks *Forks) MarshalJSON() ([]byte, error) {
+	forks.mux.RLock()
+	defer forks.mux.RUnlock()
+	return json.Marshal(forks.reorgs)
+}
+
+func toInt(value interface{}) int64 {
+	switch val := value.(type) {
+	case int:
+		return int64(val)
+	case uint64:
+		return int64(val)
+	}
+	return 0
+}
+
+func toStrings(arr interface{}) []string {
+	output := make([]string, 0)
+	if values, ok := arr.([]interface{}); ok {
+		for _, value := range values {
+			output = append(output, value.(string))
+		}
+	}
+	return output
+}
+
+// Restore reads the reorgs of the backup
+func (forks *Forks) Restore(arr []interface{}) {
+	for _, obj := range arr {
+		raw := obj.(map[interface{}]interface{})
+		number, _ := raw["block"].(string)
+		reorg := NewReorg(number, uint64(toInt(raw["timestamp"])))
+		reorg.Depth = int(toInt(raw["depth"]))
+		reorg.Detected = toInt(raw["detected"])
+		reorg.Reverted = toStrings(raw["reverted"])
+		reorg.Replaced = toStrings(raw["replaced"])
+		if events, ok := raw["events"].(map[interface{}]interface{}); ok {
+			for label, count := range events {
+				reorg.Events[label.(string)] = int(toInt(count))
+			}
+		}
+		forks.Add(reorg)
+	}
+}
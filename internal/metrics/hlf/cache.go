@@ -1,8 +1,10 @@
 package hlf
 
 import (
+	"errors"
 	metrics "github.com/IRT-SystemX/bcm-poller/internal/metrics"
 	poller "github.com/IRT-SystemX/bcm-poller/poller"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
 	"log"
 	"math/big"
 )
@@ -13,86 +15,174 @@ type Tracking struct {
 
 type Cache struct {
 	*metrics.RawCache
-	Tracking *Tracking
+	Tracking   *Tracking
+	configFile string
 	poller.Connector
 }
 
-func NewCache(configFile string, backupFile string, restore bool, backupFrequency int64) *Cache {
+func NewCache(configFile string, backupFile string, restore bool, backupFrequency int64) (*Cache, error) {
+	raw, err := metrics.ReadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	tracking, err := parseConfig(raw)
+	if err != nil {
+		return nil, utils.NewError(utils.ErrConfig, err)
+	}
+	rawCache, err := metrics.NewRawCache(backupFile, restore, backupFrequency)
+	if err != nil {
+		return nil, err
+	}
 	cache := &Cache{
-		RawCache: metrics.NewRawCache(backupFile, restore, backupFrequency),
-		Tracking: parseConfig(configFile),
+		RawCache:   rawCache,
+		Tracking:   tracking,
+		configFile: configFile,
 	}
-	raw := cache.LoadBackup()
-	if raw != nil {
-		metrics.UnmarshalTrackingEvents(raw["tracking"].(map[interface{}]interface{})["events"].([]interface{}), cache.Tracking.Events)
+	if _, ok := cache.RawCache.Stats["mismatch"]; !ok {
+		cache.RawCache.Stats["mismatch"] = metrics.NewStats()
+	}
+	if err = cache.RawCache.SetWindows(raw); err != nil {
+		return nil, utils.NewError(utils.ErrConfig, err)
+	}
+	distincts := metrics.NewDistincts(&cache.Tracking.Events)
+	cache.RawCache.Backup = map[string]interface{}{"stats": cache.Stats, "tracking": cache.Tracking, "distinct": distincts}
+	backup, err := cache.LoadBackup()
+	if err != nil {
+		return nil, err
+	}
+	if backup != nil {
+		metrics.UnmarshalTrackingEvents(backup["tracking"].(map[interface{}]interface{})["events"].([]interface{}), cache.Tracking.Events)
+		distincts.Restore(backup["distinct"])
 	}
-	return cache
+	return cache, nil
 }
 
 func (cache *Cache) SetReady() {
 	cache.RawCache.SetReady()
 }
 
+// Apply counts the block under the lock of the cache, the observers being notified and the backup written after
 func (cache *Cache) Apply(event interface{}) {
 	blockEvent := interface{}(event).(*BlockCacheEvent)
+	cache.Lock()
+	notifications, snapshot := cache.apply(blockEvent)
+	cache.Unlock()
+	cache.Notify(notifications...)
+	cache.Write(snapshot)
+}
+
+func (cache *Cache) apply(blockEvent *BlockCacheEvent) ([]*metrics.Notification, *metrics.Snapshot) {
+	metrics.StartEvents(cache.Tracking.Events, blockEvent.Number())
 	cache.Stats["block"].Increment(blockEvent.Timestamp(), blockEvent.Number())
+	notification := metrics.NewNotification(metrics.BLOCK, blockEvent.Number(), blockEvent.Hash(), blockEvent.Timestamp())
+	notification.ParentHash = blockEvent.ParentHash()
+	notifications := []*metrics.Notification{notification}
 	if len(blockEvent.Transactions) > 0 {
 		for _, tx := range blockEvent.Transactions {
 			cache.Stats["transaction"].Increment(tx.Timestamp, blockEvent.Number())
 			for _, event := range cache.Tracking.Events {
-				var check bool = true
-				for _, rule := range event.Rules() {
-					check = check && cache.check(rule, tx)
-				}
-				if check {
+				if cache.match(event, tx) {
 					log.Printf("> detect event %s", event.Label)
-					event.Increment(tx.Timestamp, blockEvent.Number())
+					event.Apply(tx.Timestamp, blockEvent.Number(), tx.Sample)
+					notification := metrics.NewNotification(metrics.DETECT, blockEvent.Number(), blockEvent.Hash(), tx.Timestamp)
+					notification.Label = event.Label
+					notification.Data = tx
+					notifications = append(notifications, notification)
 				}
 			}
 		}
 	}
-	cache.RawCache.Save()
+	if blockEvent.Mismatch {
+		cache.Stats["mismatch"].Increment(blockEvent.Timestamp(), blockEvent.Number())
+	}
+	cache.RawCache.Tick(blockEvent.Timestamp(), blockEvent.Number())
+	for _, event := range cache.Tracking.Events {
+		event.Tick(blockEvent.Timestamp(), blockEvent.Number())
+	}
+	cache.RawCache.ApplyHead(blockEvent.Number(), blockEvent.Hash())
+	return notifications, cache.RawCache.Save()
 }
 
 func (cache *Cache) Revert(event interface{}) {
 	blockEvent := interface{}(event).(*BlockCacheEvent)
-	cache.Stats["block"].Decrement()
+	cache.Lock()
+	cache.revert(blockEvent)
+	cache.Unlock()
+	cache.Notify(metrics.NewNotification(metrics.REVERT, blockEvent.Number(), blockEvent.Hash(), blockEvent.Timestamp()))
+}
+
+func (cache *Cache) revert(blockEvent *BlockCacheEvent) {
+	cache.Stats["block"].Decrement(blockEvent.Number())
 	if len(blockEvent.Transactions) > 0 {
-		cache.Stats["transaction"].Substract(big.NewInt(int64(len(blockEvent.Transactions))))
+		cache.Stats["transaction"].Rollback(big.NewInt(int64(len(blockEvent.Transactions))), blockEvent.Number())
 		for _, tx := range blockEvent.Transactions {
 			for _, event := range cache.Tracking.Events {
-				var check bool = true
-				for _, rule := range event.Rules() {
-					check = check && cache.check(rule, tx)
-				}
-				if check {
+				if cache.match(event, tx) {
 					//log.Printf("> revert event %s", event.Label)
-					event.Decrement()
+					event.Revert(blockEvent.Number(), tx.Sample)
 				}
 			}
 		}
 	}
+	cache.RawCache.Untick(blockEvent.Number())
+	for _, event := range cache.Tracking.Events {
+		event.Untick(blockEvent.Number())
+	}
+	cache.RawCache.RevertHead(blockEvent.Number(), blockEvent.ParentHash())
 }
 
-func parseConfig(config string) *Tracking {
+func parseConfig(raw map[interface{}]interface{}) (*Tracking, error) {
 	tracking := &Tracking{Events: make([]*metrics.Event, 0)}
-	raw := metrics.LoadConfig(config)
 	if raw != nil {
-		events := metrics.UnmarshalEvents(raw, "events")
-		for key, value := range events {
-			tracking.Events = append(tracking.Events, metrics.NewEvent(key, value))
+		events, err := metrics.UnmarshalEvents(raw, "events")
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			if err = checkEvent(event); err != nil {
+				return nil, err
+			}
+		}
+		tracking.Events = append(tracking.Events, events...)
+	}
+	return tracking, nil
+}
+
+// fields of the rules checked against the transactions of Fabric, and of the aggregates sampled from them
+var (
+	ruleFields      = map[metrics.Field]bool{metrics.TO: true, metrics.METHOD: true}
+	aggregateFields = map[metrics.Field]bool{metrics.FROM: true, metrics.TO: true, metrics.METHOD: true}
+)
+
+// checkEvent rejects the rules and the aggregates on fields which are not filled in for Fabric, which would never match
+func checkEvent(event *metrics.Event) error {
+	for _, rule := range event.Rules() {
+		if !ruleFields[rule.Field] {
+			err := rule.Error("field '" + string(rule.Field) + "' not available on Fabric, expecting to or method")
+			err.(*metrics.ParseError).Label = event.Label
+			return err
 		}
 	}
-	return tracking
+	for _, aggregate := range event.Aggregates {
+		if aggregate.Function() != metrics.DISTINCT || !aggregateFields[aggregate.Field()] {
+			return errors.New("Error parsing event " + event.Label + ": aggregate " + aggregate.Name + " not available on Fabric, expecting distinct of from, to or method")
+		}
+	}
+	return nil
+}
+
+func (cache *Cache) match(event *metrics.Event, tx *TxEvent) bool {
+	return event.Match(func(rule *metrics.EventRule) bool {
+		return cache.check(rule, tx)
+	})
 }
 
-func (*Cache) check(rule *metrics.EventRule, obj interface{}) bool {
-	tx := obj.(*TxEvent)
+func (*Cache) check(rule *metrics.EventRule, tx *TxEvent) bool {
 	switch rule.Field {
 	case metrics.TO:
-		return rule.Value == tx.Chaincode
+		return rule.MatchString(tx.Chaincode)
 	case metrics.METHOD:
-		return rule.Value == tx.Method
+		return rule.MatchString(tx.Method)
 	}
 	return false
 }
@@ -0,0 +1,114 @@
+package hlf
+
+import (
+	metrics "github.com/IRT-SystemX/bcm-poller/internal/metrics"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
+	"log"
+	"math/big"
+)
+
+func (cache *Cache) findEvent(label string) int {
+	for i, event := range cache.Tracking.Events {
+		if event.Label == label {
+			return i
+		}
+	}
+	return -1
+}
+
+func (cache *Cache) AddEvent(label string, raw interface{}) error {
+	event, err := metrics.UnmarshalEvent(label, raw)
+	if err != nil {
+		return err
+	}
+	if err = checkEvent(event); err != nil {
+		return utils.NewError(utils.ErrConfig, err)
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.findEvent(label) >= 0 {
+		return metrics.ErrDuplicate
+	}
+	event.SetOrigin(cache.Origin())
+	cache.Tracking.Events = append(cache.Tracking.Events, event)
+	log.Printf("Tracking event %s from block #%s", label, event.Origin())
+	return nil
+}
+
+func (cache *Cache) RemoveEvent(label string) error {
+	cache.Lock()
+	defer cache.Unlock()
+	i := cache.findEvent(label)
+	if i < 0 {
+		return metrics.ErrUnknown
+	}
+	cache.Tracking.Events = append(cache.Tracking.Events[:i], cache.Tracking.Events[i+1:]...)
+	log.Printf("Untracking event %s", label)
+	return nil
+}
+
+func (*Cache) AddAddress(kind string, label string, id string) error {
+	return metrics.ErrUnsupported
+}
+
+func (*Cache) RemoveAddress(kind string, label string) error {
+	return metrics.ErrUnsupported
+}
+
+// Reload applies the configuration file again, keeping the counters of what is still tracked
+func (cache *Cache) Reload() error {
+	raw, err := metrics.ReadConfig(cache.configFile)
+	if err != nil {
+		return err
+	}
+	tracking, err := parseConfig(raw)
+	if err != nil {
+		return utils.NewError(utils.ErrConfig, err)
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	cache.Tracking.Events = metrics.MergeEvents(cache.Tracking.Events, tracking.Events, cache.Origin())
+	log.Printf("Reloaded %s: %d events", cache.configFile, len(cache.Tracking.Events))
+	return nil
+}
+
+func (cache *Cache) Tracked(label string) bool {
+	cache.RLock()
+	defer cache.RUnlock()
+	return cache.findEvent(label) >= 0
+}
+
+// SetOrigin starts the events which were not restored from the backup at the first synced block
+func (cache *Cache) SetOrigin(number *big.Int) {
+	cache.Lock()
+	defer cache.Unlock()
+	for _, event := range cache.Tracking.Events {
+		if event.Origin() == nil {
+			event.SetOrigin(number)
+		}
+	}
+}
+
+// Backfill counts the transactions of a past block for the given events which did not count it yet
+func (cache *Cache) Backfill(event interface{}, labels []string) {
+	blockEvent := interface{}(event).(*BlockCacheEvent)
+	cache.Lock()
+	defer cache.Unlock()
+	for _, label := range labels {
+		i := cache.findEvent(label)
+		if i < 0 {
+			continue
+		}
+		event := cache.Tracking.Events[i]
+		if event.Covered(blockEvent.Number()) {
+			continue
+		}
+		for _, tx := range blockEvent.Transactions {
+			if cache.match(event, tx) {
+				log.Printf("> backfill event %s", event.Label)
+				event.Merge(tx.Sample)
+			}
+		}
+		event.Cover(blockEvent.Number())
+	}
+}
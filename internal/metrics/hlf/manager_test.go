@@ -0,0 +1,110 @@
+package hlf
+
+import (
+	"errors"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newBlock(number int64, txs ...*TxEvent) *BlockCacheEvent {
+	return &BlockCacheEvent{number: big.NewInt(number), hash: "hash" + big.NewInt(number).String(), timestamp: uint64(1000 + number), Transactions: txs}
+}
+
+func TestBackfillAfterRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config.yml")
+	if err = ioutil.WriteFile(config, []byte("events:\n  invoke: \"to = mycc\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backupFile := filepath.Join(dir, "backup.json")
+	blocks := []*BlockCacheEvent{
+		newBlock(0),
+		newBlock(1, &TxEvent{Chaincode: "mycc", Method: "set"}),
+		newBlock(2, &TxEvent{Chaincode: "mycc", Method: "get"}, &TxEvent{Chaincode: "other", Method: "set"}),
+		newBlock(3, &TxEvent{Chaincode: "mycc", Method: "set"}),
+	}
+
+	cache, err := NewCache(config, backupFile, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.SetOrigin(big.NewInt(0))
+	for _, block := range blocks {
+		cache.Apply(block)
+	}
+	if err = cache.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = NewCache(config, backupFile, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin := cache.Origin(); origin == nil || origin.Int64() != 4 {
+		t.Fatalf("origin after restore: got %v, want 4", origin)
+	}
+	if err = cache.AddEvent("set", "method = set"); err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range blocks {
+		cache.Backfill(block, []string{"invoke", "set"})
+	}
+	counts := map[string]string{}
+	for _, event := range cache.Tracking.Events {
+		counts[event.Label] = event.Count
+	}
+	if counts["invoke"] != "3" {
+		t.Errorf("invoke restored: got %s, want 3", counts["invoke"])
+	}
+	if counts["set"] != "3" {
+		t.Errorf("set backfilled: got %s, want 3", counts["set"])
+	}
+}
+
+func TestAddEventBeforeFirstBlock(t *testing.T) {
+	cache, err := NewCache("", "", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin := cache.Origin(); origin != nil {
+		t.Fatalf("origin without block: got %v, want nil", origin)
+	}
+	if err = cache.AddEvent("set", "method = set"); err != nil {
+		t.Fatal(err)
+	}
+	cache.Backfill(newBlock(0, &TxEvent{Chaincode: "mycc", Method: "set"}), []string{"set"})
+	cache.Apply(newBlock(1, &TxEvent{Chaincode: "mycc", Method: "set"}))
+	cache.Backfill(newBlock(1, &TxEvent{Chaincode: "mycc", Method: "set"}), []string{"set"})
+	if count := cache.Tracking.Events[0].Count; count != "2" {
+		t.Errorf("set: got %s, want 2", count)
+	}
+}
+
+func TestRejectUnavailableFields(t *testing.T) {
+	cache, err := NewCache("", "", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range []string{"value > 1", "from = creator", "method = set and not (to = mycc or deploy)"} {
+		if err = cache.AddEvent("event", rule); !errors.Is(err, utils.ErrConfig) {
+			t.Errorf("%s: got %v, want a config error", rule, err)
+		}
+	}
+	if err = cache.AddEvent("callers", map[interface{}]interface{}{"rules": "to = mycc", "aggregate": "sum(value)"}); !errors.Is(err, utils.ErrConfig) {
+		t.Errorf("sum(value): got %v, want a config error", err)
+	}
+	if err = cache.AddEvent("creators", map[interface{}]interface{}{"rules": "to = mycc", "aggregate": "distinct(from)"}); err != nil {
+		t.Errorf("distinct(from): %v", err)
+	}
+	if len(cache.Tracking.Events) != 1 {
+		t.Errorf("got %d events, want 1", len(cache.Tracking.Events))
+	}
+}
@@ -3,7 +3,9 @@ package hlf
 import (
 	"bytes"
 	b64 "encoding/base64"
+	metrics "github.com/IRT-SystemX/bcm-poller/internal/metrics"
 	poller "github.com/IRT-SystemX/bcm-poller/poller"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
 	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric-config/protolator"
 	"github.com/tidwall/gjson"
@@ -19,6 +21,7 @@ type BlockCacheEvent struct {
 	parentHash   string
 	Interval     uint64
 	timestamp    uint64
+	Mismatch     bool
 	Transactions []*TxEvent
 	poller.BlockEvent
 }
@@ -39,15 +42,36 @@ func (blockEvent *BlockCacheEvent) Timestamp() uint64 {
 	return blockEvent.timestamp
 }
 
+func (blockEvent *BlockCacheEvent) Txs() []interface{} {
+	txs := make([]interface{}, len(blockEvent.Transactions))
+	for i, tx := range blockEvent.Transactions {
+		txs[i] = tx
+	}
+	return txs
+}
+
 type TxEvent struct {
-	id        string
-	creator   string
-	Timestamp uint64
-	Chaincode string
-	Method    string
+	Id        string `json:"id"`
+	Creator   string `json:"creator"`
+	Timestamp uint64 `json:"timestamp"`
+	Chaincode string `json:"chaincode"`
+	Method    string `json:"method"`
+}
+
+func (tx *TxEvent) Sample(field metrics.Field) string {
+	switch field {
+	case metrics.FROM:
+		return tx.Creator
+	case metrics.TO:
+		return tx.Chaincode
+	case metrics.METHOD:
+		return tx.Method
+	}
+	return ""
 }
 
 type Processor struct {
+	last *BlockCacheEvent
 }
 
 func NewProcessor() *Processor {
@@ -64,11 +88,21 @@ func (processor *Processor) NewBlockEvent(number *big.Int, parentHash string, ha
 	return interface{}(blockEvent).(poller.BlockEvent)
 }
 
-func (processor *Processor) Process(obj interface{}, event poller.BlockEvent, listening bool) {
+// check raises an alert when the block does not follow the last block checked, the ledger of the peer diverging
+func (processor *Processor) check(blockEvent *BlockCacheEvent) {
+	last := processor.last
+	if last != nil && new(big.Int).Add(last.Number(), big.NewInt(1)).Cmp(blockEvent.Number()) == 0 && last.Hash() != blockEvent.ParentHash() {
+		log.Printf("Alert: previous hash %s of block #%s != hash %s of block #%s", blockEvent.ParentHash(), blockEvent.Number().String(), last.Hash(), last.Number().String())
+		blockEvent.Mismatch = true
+	}
+	processor.last = blockEvent
+}
+
+func (processor *Processor) Process(obj interface{}, event poller.BlockEvent, listening bool) error {
 	var buf bytes.Buffer
 	err := protolator.DeepMarshalJSON(&buf, obj.(proto.Message))
 	if err != nil {
-		log.Fatalln("DeepMarshalJSON error:", err)
+		return utils.NewError(utils.ErrDecode, err)
 	}
 	blockEvent := interface{}(event).(*BlockCacheEvent)
 	txs := gjson.Get(buf.String(), "data.data").Array()
@@ -83,22 +117,26 @@ func (processor *Processor) Process(obj interface{}, event poller.BlockEvent, li
 		args := gjson.Get(buf.String(), prefix+".payload.data.actions.0.payload.chaincode_proposal_payload.input.chaincode_spec.input.args").Array()
 		timestamp, err := time.Parse("2006-01-02T15:04:05Z", timestampStr)
 		if err != nil {
-			log.Fatal(err)
+			return utils.NewError(utils.ErrDecode, err)
 		}
-		txEvent := &TxEvent{id: id, creator: creator, Timestamp: uint64(timestamp.Unix()), Chaincode: name}
+		txEvent := &TxEvent{Id: id, Creator: creator, Timestamp: uint64(timestamp.Unix()), Chaincode: name}
 		for _, val := range args {
 			value, err := b64.StdEncoding.DecodeString(val.String())
 			if err != nil {
-				log.Fatal(err)
+				return utils.NewError(utils.ErrDecode, err)
 			}
 			//log.Printf("value: %s\n", value)
 			txEvent.Method = string(value)
 			break
 		}
-		log.Printf("Process tx %s > %s_%s", txEvent.id, txEvent.Chaincode, txEvent.Method)
+		log.Printf("Process tx %s > %s_%s", txEvent.Id, txEvent.Chaincode, txEvent.Method)
 		blockEvent.Transactions[i] = txEvent
 		if blockEvent.timestamp == 0 {
 			blockEvent.timestamp = txEvent.Timestamp
 		}
 	}
+	if listening {
+		processor.check(blockEvent)
+	}
+	return nil
 }
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"math/big"
+)
+
+type NotificationType string
+
+const (
+	BLOCK   NotificationType = "block"
+	DETECT  NotificationType = "event"
+	REVERT  NotificationType = "revert"
+	MINER   NotificationType = "miner"
+	BALANCE NotificationType = "balance"
+)
+
+type Notification struct {
+	Type       NotificationType `json:"type"`
+	Label      string           `json:"label,omitempty"`
+	Number     string           `json:"block"`
+	Hash       string           `json:"hash,omitempty"`
+	ParentHash string           `json:"parentHash,omitempty"`
+	Timestamp  uint64           `json:"timestamp"`
+	Data       interface{}      `json:"data,omitempty"`
+}
+
+func NewNotification(kind NotificationType, number *big.Int, hash string, timestamp uint64) *Notification {
+	return &Notification{Type: kind, Number: number.String(), Hash: hash, Timestamp: timestamp}
+}
+
+type Observer interface {
+	Notify(*Notification)
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	poller "github.com/IRT-SystemX/bcm-poller/poller"
+	"math/big"
+)
+
+const (
+	PENDING_BLOCK       = "pending_block"
+	PENDING_TRANSACTION = "pending_transaction"
+)
+
+// PendingBlock is a block waiting for its confirmations
+type PendingBlock interface {
+	poller.BlockEvent
+	Timestamp() uint64
+	Txs() []interface{}
+}
+
+// Pending counts the blocks and the transactions waiting for their confirmations beside the confirmed ones
+type Pending struct {
+	cache *RawCache
+}
+
+// Pending resets the pending counters, the pending blocks being synced again after a restore
+func (cache *RawCache) Pending() *Pending {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.Stats[PENDING_BLOCK] = NewStats()
+	cache.Stats[PENDING_TRANSACTION] = NewStats()
+	return &Pending{cache: cache}
+}
+
+func (pending *Pending) Add(event poller.BlockEvent) {
+	block := event.(PendingBlock)
+	pending.cache.Lock()
+	defer pending.cache.Unlock()
+	pending.cache.Stats[PENDING_BLOCK].Increment(block.Timestamp(), block.Number())
+	if txs := len(block.Txs()); txs > 0 {
+		pending.cache.Stats[PENDING_TRANSACTION].Update(big.NewInt(int64(txs)), block.Timestamp(), block.Number())
+	}
+}
+
+func (pending *Pending) Remove(event poller.BlockEvent) {
+	block := event.(PendingBlock)
+	pending.cache.Lock()
+	defer pending.cache.Unlock()
+	pending.cache.Stats[PENDING_BLOCK].Decrement(block.Number())
+	if txs := len(block.Txs()); txs > 0 {
+		pending.cache.Stats[PENDING_TRANSACTION].Rollback(big.NewInt(int64(txs)), block.Number())
+	}
+}
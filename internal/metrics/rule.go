@@ -0,0 +1,458 @@
+package metrics
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+type Field string
+
+const (
+	FROM    Field = "from"
+	TO      Field = "to"
+	VALUE   Field = "value"
+	DEPLOY  Field = "deploy"
+	METHOD  Field = "method"
+	TOPIC   Field = "topic"
+	EVENT   Field = "event"
+	ADDRESS Field = "address"
+	GAS     Field = "gas"
+	UNKNOWN Field = ""
+)
+
+var fields = [...]Field{FROM, TO, VALUE, DEPLOY, METHOD, TOPIC, EVENT, ADDRESS, GAS, UNKNOWN}
+
+func parseField(field string) Field {
+	for _, f := range fields {
+		if field == string(f) {
+			return f
+		}
+	}
+	return UNKNOWN
+}
+
+type Operator string
+
+const (
+	EQ   Operator = "="
+	NE   Operator = "!="
+	LT   Operator = "<"
+	GT   Operator = ">"
+	LE   Operator = "<="
+	GE   Operator = ">="
+	IN   Operator = "in"
+	NONE Operator = ""
+)
+
+var operators = [...]Operator{EQ, NE, LT, GT, LE, GE, IN, NONE}
+
+func parseOperator(op string) Operator {
+	for _, o := range operators {
+		if op == string(o) {
+			return o
+		}
+	}
+	return NONE
+}
+
+// operators accepted by each field, a field without operator is a bare flag
+var allowed = map[Field][]Operator{
+	FROM:    {EQ, NE, IN},
+	TO:      {EQ, NE, IN},
+	VALUE:   {EQ, NE, LT, GT, LE, GE, IN},
+	DEPLOY:  {NONE},
+	METHOD:  {EQ, NE, IN},
+	TOPIC:   {EQ, NE, IN},
+	EVENT:   {EQ, NE, IN},
+	ADDRESS: {EQ, NE, IN},
+	GAS:     {EQ, NE, LT, GT, LE, GE, IN},
+}
+
+var numericFields = map[Field]bool{VALUE: true, GAS: true}
+
+func isAllowed(field Field, operator Operator) bool {
+	for _, op := range allowed[field] {
+		if op == operator {
+			return true
+		}
+	}
+	return false
+}
+
+type ParseError struct {
+	Label  string
+	Rule   string
+	Column int
+	Msg    string
+}
+
+func (err *ParseError) Error() string {
+	return fmt.Sprintf("Error parsing rule %s at column %d: %s\n\t%s\n\t%s^", err.Label, err.Column, err.Msg, err.Rule, strings.Repeat(" ", err.Column-1))
+}
+
+type Expr interface {
+	Eval(check func(*EventRule) bool) bool
+	Walk(visit func(*EventRule))
+}
+
+type AndExpr struct {
+	Left  Expr
+	Right Expr
+}
+
+func (expr *AndExpr) Eval(check func(*EventRule) bool) bool {
+	return expr.Left.Eval(check) && expr.Right.Eval(check)
+}
+
+func (expr *AndExpr) Walk(visit func(*EventRule)) {
+	expr.Left.Walk(visit)
+	expr.Right.Walk(visit)
+}
+
+type OrExpr struct {
+	Left  Expr
+	Right Expr
+}
+
+func (expr *OrExpr) Eval(check func(*EventRule) bool) bool {
+	return expr.Left.Eval(check) || expr.Right.Eval(check)
+}
+
+func (expr *OrExpr) Walk(visit func(*EventRule)) {
+	expr.Left.Walk(visit)
+	expr.Right.Walk(visit)
+}
+
+type NotExpr struct {
+	Expr Expr
+}
+
+func (expr *NotExpr) Eval(check func(*EventRule) bool) bool {
+	return !expr.Expr.Eval(check)
+}
+
+func (expr *NotExpr) Walk(visit func(*EventRule)) {
+	expr.Expr.Walk(visit)
+}
+
+type EventRule struct {
+	Field    Field
+	Operator Operator
+	Value    string
+	Values   []string
+	source   string
+	column   int
+}
+
+func (rule *EventRule) Eval(check func(*EventRule) bool) bool {
+	return check(rule)
+}
+
+func (rule *EventRule) Walk(visit func(*EventRule)) {
+	visit(rule)
+}
+
+func (rule *EventRule) Error(msg string) error {
+	return &ParseError{Rule: rule.source, Column: rule.column, Msg: msg}
+}
+
+func (rule *EventRule) contains(value string) bool {
+	for _, val := range rule.Values {
+		if val == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *EventRule) MatchString(value string) bool {
+	switch rule.Operator {
+	case EQ, IN:
+		return rule.contains(value)
+	case NE:
+		return !rule.contains(value)
+	}
+	return false
+}
+
+func (rule *EventRule) MatchAny(values []string) bool {
+	for _, value := range values {
+		if rule.contains(value) {
+			return rule.Operator != NE
+		}
+	}
+	return rule.Operator == NE
+}
+
+func (rule *EventRule) MatchInt(value *big.Int) bool {
+	if value == nil {
+		return false
+	}
+	for _, val := range rule.Values {
+		ref, _ := new(big.Int).SetString(val, 10)
+		switch cmp := value.Cmp(ref); rule.Operator {
+		case EQ, IN:
+			if cmp == 0 {
+				return true
+			}
+		case NE:
+			if cmp == 0 {
+				return false
+			}
+		case LT:
+			return cmp < 0
+		case GT:
+			return cmp > 0
+		case LE:
+			return cmp <= 0
+		case GE:
+			return cmp >= 0
+		}
+	}
+	return rule.Operator == NE
+}
+
+type token struct {
+	text   string
+	column int
+}
+
+type ruleParser struct {
+	input string
+	pos   int
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isDelimiter(c byte) bool {
+	return isSpace(c) || strings.IndexByte("()[],=!<>", c) >= 0
+}
+
+func (parser *ruleParser) errorf(column int, format string, args ...interface{}) error {
+	return &ParseError{Rule: parser.input, Column: column, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (parser *ruleParser) skipSpaces() {
+	for parser.pos < len(parser.input) && isSpace(parser.input[parser.pos]) {
+		parser.pos++
+	}
+}
+
+// scan returns the next token without consuming it
+func (parser *ruleParser) scan() (token, int) {
+	parser.skipSpaces()
+	start := parser.pos
+	if start >= len(parser.input) {
+		return token{text: "", column: start + 1}, start
+	}
+	end := start + 1
+	switch c := parser.input[start]; {
+	case strings.IndexByte("()[],", c) >= 0:
+	case c == '=':
+	case c == '!' || c == '<' || c == '>':
+		if end < len(parser.input) && parser.input[end] == '=' {
+			end++
+		}
+	case c == '&' || c == '|':
+		if end < len(parser.input) && parser.input[end] == c {
+			end++
+		}
+	default:
+		for end < len(parser.input) && !isDelimiter(parser.input[end]) {
+			end++
+		}
+	}
+	return token{text: parser.input[start:end], column: start + 1}, end
+}
+
+func (parser *ruleParser) peek() token {
+	tok, _ := parser.scan()
+	return tok
+}
+
+func (parser *ruleParser) next() token {
+	tok, end := parser.scan()
+	parser.pos = end
+	return tok
+}
+
+func (parser *ruleParser) accept(keywords ...string) bool {
+	tok, end := parser.scan()
+	for _, keyword := range keywords {
+		if strings.EqualFold(tok.text, keyword) {
+			parser.pos = end
+			return true
+		}
+	}
+	return false
+}
+
+func (parser *ruleParser) expect(text string) error {
+	tok := parser.next()
+	if tok.text != text {
+		return parser.errorf(tok.column, "expected '%s' but found '%s'", text, tok.text)
+	}
+	return nil
+}
+
+// value reads a literal which may be quoted or contain a signature such as Transfer(address,uint256)
+func (parser *ruleParser) value() (token, error) {
+	parser.skipSpaces()
+	start := parser.pos
+	if start < len(parser.input) && (parser.input[start] == '"' || parser.input[start] == '\'') {
+		end := strings.IndexByte(parser.input[start+1:], parser.input[start])
+		if end < 0 {
+			return token{}, parser.errorf(start+1, "unterminated string")
+		}
+		parser.pos = start + end + 2
+		return token{text: parser.input[start+1 : start+end+1], column: start + 1}, nil
+	}
+	depth := 0
+	for ; parser.pos < len(parser.input); parser.pos++ {
+		c := parser.input[parser.pos]
+		if c == '(' {
+			depth++
+		} else if c == ')' {
+			if depth == 0 {
+				break
+			}
+			depth--
+		} else if depth == 0 && (isSpace(c) || c == ',' || c == ']') {
+			break
+		}
+	}
+	if depth > 0 {
+		return token{}, parser.errorf(start+1, "unbalanced parenthesis")
+	}
+	if parser.pos == start {
+		return token{}, parser.errorf(start+1, "expected value")
+	}
+	return token{text: parser.input[start:parser.pos], column: start + 1}, nil
+}
+
+func (parser *ruleParser) literal(field Field) (string, error) {
+	val, err := parser.value()
+	if err != nil {
+		return "", err
+	}
+	if numericFields[field] {
+		if _, ok := new(big.Int).SetString(val.text, 10); !ok {
+			return "", parser.errorf(val.column, "invalid integer '%s'", val.text)
+		}
+	}
+	return val.text, nil
+}
+
+func (parser *ruleParser) parseOr() (Expr, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for parser.accept("or", "||") {
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &OrExpr{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (parser *ruleParser) parseAnd() (Expr, error) {
+	left, err := parser.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for parser.accept("and", "&&") {
+		right, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &AndExpr{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (parser *ruleParser) parseUnary() (Expr, error) {
+	if parser.accept("not", "!") {
+		expr, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &NotExpr{Expr: expr}, nil
+	}
+	if parser.accept("(") {
+		expr, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err = parser.expect(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+	return parser.parseCondition()
+}
+
+func (parser *ruleParser) parseCondition() (Expr, error) {
+	tok := parser.next()
+	field := parseField(strings.ToLower(tok.text))
+	if field == UNKNOWN {
+		if len(tok.text) == 0 {
+			return nil, parser.errorf(tok.column, "unexpected end of rule")
+		}
+		return nil, parser.errorf(tok.column, "unknown field '%s'", tok.text)
+	}
+	rule := &EventRule{Field: field, Operator: NONE, Values: make([]string, 0), source: parser.input, column: tok.column}
+	opToken := parser.peek()
+	if parser.accept("in") {
+		rule.Operator = IN
+		if err := parser.expect("["); err != nil {
+			return nil, err
+		}
+		for {
+			val, err := parser.literal(field)
+			if err != nil {
+				return nil, err
+			}
+			rule.Values = append(rule.Values, val)
+			if !parser.accept(",") {
+				break
+			}
+		}
+		if err := parser.expect("]"); err != nil {
+			return nil, err
+		}
+	} else if op := parseOperator(opToken.text); op != NONE && op != IN {
+		parser.next()
+		rule.Operator = op
+		val, err := parser.literal(field)
+		if err != nil {
+			return nil, err
+		}
+		rule.Value = val
+		rule.Values = append(rule.Values, val)
+	}
+	if !isAllowed(field, rule.Operator) {
+		if rule.Operator == NONE {
+			return nil, parser.errorf(opToken.column, "missing operator after '%s'", field)
+		}
+		return nil, parser.errorf(opToken.column, "operator '%s' not allowed on '%s'", rule.Operator, field)
+	}
+	return rule, nil
+}
+
+func ParseRule(input string) (Expr, error) {
+	parser := &ruleParser{input: input}
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := parser.peek(); len(tok.text) > 0 {
+		return nil, parser.errorf(tok.column, "unexpected '%s'", tok.text)
+	}
+	return expr, nil
+}
@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"math/big"
+	"testing"
+)
+
+type sample struct {
+	fields map[Field]string
+	topics []string
+	value  *big.Int
+	deploy bool
+}
+
+func (s *sample) check(rule *EventRule) bool {
+	switch rule.Field {
+	case VALUE:
+		return rule.MatchInt(s.value)
+	case GAS:
+		return rule.MatchInt(nil)
+	case TOPIC:
+		return rule.MatchAny(s.topics)
+	case DEPLOY:
+		return s.deploy
+	}
+	return rule.MatchString(s.fields[rule.Field])
+}
+
+func TestParseRule(t *testing.T) {
+	transfer := &sample{
+		fields: map[Field]string{FROM: "0xa", TO: "0xb", METHOD: "Transfer(address,uint256)"},
+		topics: []string{"0x1", "0x2"},
+		value:  big.NewInt(10),
+	}
+	deploy := &sample{fields: map[Field]string{FROM: "0xc"}, value: big.NewInt(0), deploy: true}
+	tests := []struct {
+		rule     string
+		transfer bool
+		deploy   bool
+	}{
+		{"from = 0xa", true, false},
+		{"from != 0xa", false, true},
+		{"FROM = 0xa", true, false},
+		{"from in [0xa, 0xc]", true, true},
+		{"to in [0xd]", false, false},
+		{"method = Transfer(address,uint256)", true, false},
+		{"method = 'Transfer(address,uint256)'", true, false},
+		{"method = \"Transfer(address,uint256)\"", true, false},
+		{"topic = 0x2", true, false},
+		{"topic != 0x2", false, true},
+		{"topic in [0x3, 0x1]", true, false},
+		{"value > 5", true, false},
+		{"value >= 10", true, false},
+		{"value < 10", false, true},
+		{"value <= 0", false, true},
+		{"value = 10", true, false},
+		{"value != 10", false, true},
+		{"value in [0, 1]", false, true},
+		{"gas > 0", false, false},
+		{"deploy", false, true},
+		{"from = 0xc or from = 0xa and value > 100", false, true},
+		{"from = 0xa and value > 100 or from = 0xc", false, true},
+		{"(from = 0xc or from = 0xa) and value > 100", false, false},
+		{"from = 0xa || deploy && value > 100", true, false},
+		{"not deploy", true, false},
+		{"! deploy and from = 0xc", false, false},
+		{"not (deploy or value > 5)", false, false},
+		{"not not deploy", false, true},
+		{"((deploy))", false, true},
+		{"deploy and (from = 0xa or (to = 0xb and not value < 1))", false, false},
+	}
+	for _, test := range tests {
+		expr, err := ParseRule(test.rule)
+		if err != nil {
+			t.Errorf("%s: %v", test.rule, err)
+			continue
+		}
+		if got := expr.Eval(transfer.check); got != test.transfer {
+			t.Errorf("%s on transfer: got %v, want %v", test.rule, got, test.transfer)
+		}
+		if got := expr.Eval(deploy.check); got != test.deploy {
+			t.Errorf("%s on deploy: got %v, want %v", test.rule, got, test.deploy)
+		}
+	}
+}
+
+func TestParseRuleWalk(t *testing.T) {
+	expr, err := ParseRule("from = 0xa and not (to in [0xb, 0xc] or value > 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := make([]*EventRule, 0)
+	expr.Walk(func(rule *EventRule) {
+		rules = append(rules, rule)
+	})
+	if len(rules) != 3 {
+		t.Fatalf("got %d rules, want 3", len(rules))
+	}
+	if rule := rules[1]; rule.Field != TO || rule.Operator != IN || len(rule.Values) != 2 || rule.Values[1] != "0xc" {
+		t.Errorf("got %+v, want to in [0xb, 0xc]", rule)
+	}
+	if rule := rules[2]; rule.Field != VALUE || rule.Operator != GT || rule.Value != "1" || rule.column != 41 {
+		t.Errorf("got %+v, want value > 1 at column 41", rule)
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	tests := []struct {
+		rule   string
+		column int
+		msg    string
+	}{
+		{"", 1, "unexpected end of rule"},
+		{"from = 0xa and", 15, "unexpected end of rule"},
+		{"sender = 0xa", 1, "unknown field 'sender'"},
+		{"from", 5, "missing operator after 'from'"},
+		{"from 0xa", 6, "missing operator after 'from'"},
+		{"from > 0xa", 6, "operator '>' not allowed on 'from'"},
+		{"deploy = 1", 8, "operator '=' not allowed on 'deploy'"},
+		{"from =", 7, "expected value"},
+		{"value > abc", 9, "invalid integer 'abc'"},
+		{"value in [1, x]", 14, "invalid integer 'x'"},
+		{"method = 'Transfer", 10, "unterminated string"},
+		{"method = Transfer(address", 10, "unbalanced parenthesis"},
+		{"(from = 0xa", 12, "expected ')' but found ''"},
+		{"from = 0xa)", 11, "unexpected ')'"},
+		{"from in 0xa", 9, "expected '[' but found '0xa'"},
+		{"from in [0xa", 13, "expected ']' but found ''"},
+		{"from = 0xa to = 0xb", 12, "unexpected 'to'"},
+		{"not", 4, "unexpected end of rule"},
+	}
+	for _, test := range tests {
+		_, err := ParseRule(test.rule)
+		parseErr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%s: got %v, want a parse error", test.rule, err)
+			continue
+		}
+		if parseErr.Column != test.column || parseErr.Msg != test.msg {
+			t.Errorf("%s: got '%s' at column %d, want '%s' at column %d", test.rule, parseErr.Msg, parseErr.Column, test.msg, test.column)
+		}
+	}
+}
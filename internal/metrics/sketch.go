@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// precision of the sketch: 2^12 registers of one byte, for a standard error of 1.6%
+const sketchPrecision uint = 12
+
+// Sketch estimates the number of distinct samples in a fixed size (HyperLogLog), without removal
+type Sketch []byte
+
+func NewSketch() Sketch {
+	return make(Sketch, 1<<sketchPrecision)
+}
+
+func sampleHash(sample string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(sample))
+	// the bits of fnv are mixed (splitmix64 finalizer) as the registers and the ranks are taken from them
+	x := hash.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (sketch Sketch) Add(sample string) {
+	x := sampleHash(sample)
+	i := x >> (64 - sketchPrecision)
+	rank := byte(bits.LeadingZeros64(x<<sketchPrecision|1<<(sketchPrecision-1)) + 1)
+	if rank > sketch[i] {
+		sketch[i] = rank
+	}
+}
+
+func (sketch Sketch) Count() int64 {
+	m := float64(len(sketch))
+	sum, zeros := 0.0, 0
+	for _, rank := range sketch {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// number of blocks kept beyond a window so that a reorg can move the head back
+const maxWindowMargin int64 = 128
+
+type windowEntry struct {
+	number    *big.Int
+	timestamp uint64
+	count     *big.Int
+}
+
+type windowHead struct {
+	number    *big.Int
+	timestamp uint64
+}
+
+type Window struct {
+	Name    string `json:"window"`
+	Count   string `json:"count"`
+	seconds uint64
+	blocks  *big.Int
+	current *big.Int
+	entries []*windowEntry
+	start   int
+	heads   []*windowHead
+}
+
+func ParseWindow(spec string) (*Window, error) {
+	window := &Window{Name: spec, current: big.NewInt(0), Count: "0", entries: make([]*windowEntry, 0), heads: make([]*windowHead, 0)}
+	value := strings.TrimSpace(spec)
+	for _, suffix := range []string{"blocks", "block", "b"} {
+		if strings.HasSuffix(value, suffix) {
+			blocks, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(value, suffix)), 10, 64)
+			if err != nil || blocks <= 0 {
+				return nil, errors.New("Error parsing window " + spec + ": expecting a number of blocks")
+			}
+			window.blocks = big.NewInt(blocks)
+			return window, nil
+		}
+	}
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseInt(strings.TrimSuffix(value, "d"), 10, 64)
+		if err != nil || days <= 0 {
+			return nil, errors.New("Error parsing window " + spec + ": expecting a number of days")
+		}
+		window.seconds = uint64(days) * 24 * 3600
+		return window, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < time.Second {
+		return nil, errors.New("Error parsing window " + spec + ": expecting a duration or a number of blocks")
+	}
+	window.seconds = uint64(duration.Seconds())
+	return window, nil
+}
+
+func ParseWindows(specs []string) ([]*Window, error) {
+	windows := make([]*Window, len(specs))
+	for i, spec := range specs {
+		window, err := ParseWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows[i] = window
+	}
+	return windows, nil
+}
+
+func (window *Window) head() *windowHead {
+	if len(window.heads) == 0 {
+		return nil
+	}
+	return window.heads[len(window.heads)-1]
+}
+
+func (window *Window) inside(entry *windowEntry) bool {
+	head := window.head()
+	if head == nil {
+		return true
+	}
+	if window.blocks != nil {
+		return new(big.Int).Sub(head.number, entry.number).Cmp(window.blocks) < 0
+	}
+	return head.timestamp < entry.timestamp+window.seconds
+}
+
+// slide moves the start of the window according to the head and drops the entries out of the margin
+func (window *Window) slide() {
+	for window.start < len(window.entries) && !window.inside(window.entries[window.start]) {
+		window.current = new(big.Int).Sub(window.current, window.entries[window.start].count)
+		window.start++
+	}
+	for window.start > 0 && window.inside(window.entries[window.start-1]) {
+		window.start--
+		window.current = new(big.Int).Add(window.current, window.entries[window.start].count)
+	}
+	if head := window.head(); head != nil {
+		limit := new(big.Int).Sub(head.number, big.NewInt(maxWindowMargin))
+		drop := 0
+		for drop < window.start && window.entries[drop].number.Cmp(limit) < 0 {
+			drop++
+		}
+		window.entries = window.entries[drop:]
+		window.start -= drop
+	}
+	window.Count = window.current.String()
+}
+
+// Tick keeps the block in the heads sorted by number, a block below the head applied out of order by the fast sync
+// not moving the window: the head only moves back on a revert with Untick
+func (window *Window) Tick(timestamp uint64, number *big.Int) {
+	i := sort.Search(len(window.heads), func(i int) bool {
+		return window.heads[i].number.Cmp(number) >= 0
+	})
+	if i < len(window.heads) && window.heads[i].number.Cmp(number) == 0 {
+		return
+	}
+	window.heads = append(window.heads, nil)
+	copy(window.heads[i+1:], window.heads[i:])
+	window.heads[i] = &windowHead{number: number, timestamp: timestamp}
+	if int64(len(window.heads)) > maxWindowMargin {
+		window.heads = window.heads[1:]
+	}
+	window.slide()
+}
+
+func (window *Window) Untick(number *big.Int) {
+	for len(window.heads) > 0 && window.head().number.Cmp(number) >= 0 {
+		window.heads = window.heads[:len(window.heads)-1]
+	}
+	window.slide()
+}
+
+// Add counts the block in its entry, the entries being kept sorted by number as the blocks may come out of order
+func (window *Window) Add(incr *big.Int, timestamp uint64, number *big.Int) {
+	i := sort.Search(len(window.entries), func(i int) bool {
+		return window.entries[i].number.Cmp(number) >= 0
+	})
+	if i < len(window.entries) && window.entries[i].number.Cmp(number) == 0 {
+		window.entries[i].count = new(big.Int).Add(window.entries[i].count, incr)
+	} else {
+		window.entries = append(window.entries, nil)
+		copy(window.entries[i+1:], window.entries[i:])
+		window.entries[i] = &windowEntry{number: number, timestamp: timestamp, count: incr}
+		if i < window.start {
+			window.start++
+		}
+	}
+	if i >= window.start {
+		window.current = new(big.Int).Add(window.current, incr)
+	}
+	window.slide()
+}
+
+func (window *Window) Remove(incr *big.Int, number *big.Int) {
+	for i := len(window.entries) - 1; i >= 0; i-- {
+		entry := window.entries[i]
+		if entry.number.Cmp(number) == 0 {
+			entry.count = new(big.Int).Sub(entry.count, incr)
+			if i >= window.start {
+				window.current = new(big.Int).Sub(window.current, incr)
+			}
+			if entry.count.Cmp(zero) <= 0 {
+				window.entries = append(window.entries[:i], window.entries[i+1:]...)
+				if i < window.start {
+					window.start--
+				}
+			}
+			break
+		}
+	}
+	window.Count = window.current.String()
+}
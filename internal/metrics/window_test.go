@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"math/big"
+	"testing"
+)
+
+func applyWindow(window *Window, numbers ...int64) {
+	for _, number := range numbers {
+		window.Add(big.NewInt(1), uint64(number*10), big.NewInt(number))
+		window.Tick(uint64(number*10), big.NewInt(number))
+	}
+}
+
+func TestWindowOutOfOrder(t *testing.T) {
+	for _, spec := range []string{"3 blocks", "30s"} {
+		inOrder, _ := ParseWindow(spec)
+		applyWindow(inOrder, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+		outOfOrder, _ := ParseWindow(spec)
+		applyWindow(outOfOrder, 3, 1, 8, 2, 10, 5, 4, 9, 7, 6)
+		for _, window := range []*Window{inOrder, outOfOrder} {
+			if window.Count != "3" {
+				t.Errorf("%s: got %s, want 3", spec, window.Count)
+			}
+			if head := window.head(); head.number.Int64() != 10 {
+				t.Errorf("%s: got head %s, want 10", spec, head.number)
+			}
+			for i := 1; i < len(window.entries); i++ {
+				if window.entries[i-1].number.Cmp(window.entries[i].number) >= 0 {
+					t.Fatalf("%s: entries not sorted at %d", spec, i)
+				}
+			}
+		}
+
+		// a gap reprocessed below the window is counted in its entry without moving the head
+		applyWindow(outOfOrder, 8)
+		if outOfOrder.Count != "4" {
+			t.Errorf("%s: got %s after block 8 again, want 4", spec, outOfOrder.Count)
+		}
+		outOfOrder.Remove(big.NewInt(1), big.NewInt(8))
+		applyWindow(outOfOrder, 2)
+		if outOfOrder.Count != "3" {
+			t.Errorf("%s: got %s after block 2 again, want 3", spec, outOfOrder.Count)
+		}
+
+		// a revert moves the head back
+		outOfOrder.Remove(big.NewInt(1), big.NewInt(10))
+		outOfOrder.Untick(big.NewInt(10))
+		if outOfOrder.Count != "3" {
+			t.Errorf("%s: got %s after revert, want 3", spec, outOfOrder.Count)
+		}
+		if head := outOfOrder.head(); head.number.Int64() != 9 {
+			t.Errorf("%s: got head %s after revert, want 9", spec, head.number)
+		}
+	}
+}
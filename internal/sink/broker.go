@@ -0,0 +1,132 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// number of messages kept by the memory broker
+const memorySize int = 1000
+
+type Message struct {
+	Topic string          `json:"topic"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Broker publishes the messages of the sink, the key ordering the messages of a topic
+type Broker interface {
+	Publish(topic string, key string, value []byte) error
+	Close() error
+}
+
+// Open returns the broker of the url: stdout, memory, file:///path/to/file or nats://host:port
+func Open(url string) (Broker, error) {
+	switch {
+	case url == "stdout":
+		return NewWriterBroker(os.Stdout), nil
+	case url == "memory":
+		return NewMemoryBroker(memorySize), nil
+	case strings.HasPrefix(url, "file://"):
+		file, err := os.OpenFile(strings.TrimPrefix(url, "file://"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return NewWriterBroker(file), nil
+	case strings.HasPrefix(url, "nats://"):
+		return NewNatsBroker(url)
+	}
+	return nil, errors.New("Unknown sink " + url + ": expecting stdout, memory, file://path or nats://host:port")
+}
+
+// WriterBroker writes the messages as JSON lines
+type WriterBroker struct {
+	mux    sync.Mutex
+	writer io.Writer
+}
+
+func NewWriterBroker(writer io.Writer) *WriterBroker {
+	return &WriterBroker{writer: writer}
+}
+
+func (broker *WriterBroker) Publish(topic string, key string, value []byte) error {
+	line, err := json.Marshal(&Message{Topic: topic, Key: key, Value: value})
+	if err != nil {
+		return err
+	}
+	broker.mux.Lock()
+	defer broker.mux.Unlock()
+	_, err = broker.writer.Write(append(line, '\n'))
+	return err
+}
+
+func (broker *WriterBroker) Close() error {
+	if closer, ok := broker.writer.(io.Closer); ok && broker.writer != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
+
+// MemoryBroker keeps the last messages, served on /sink?topic=&limit= for local testing
+type MemoryBroker struct {
+	mux      sync.RWMutex
+	size     int
+	messages []*Message
+}
+
+func NewMemoryBroker(size int) *MemoryBroker {
+	return &MemoryBroker{size: size, messages: make([]*Message, 0)}
+}
+
+func (broker *MemoryBroker) Publish(topic string, key string, value []byte) error {
+	broker.mux.Lock()
+	defer broker.mux.Unlock()
+	if len(broker.messages) >= broker.size {
+		broker.messages = broker.messages[1:]
+	}
+	broker.messages = append(broker.messages, &Message{Topic: topic, Key: key, Value: value})
+	return nil
+}
+
+func (broker *MemoryBroker) Close() error {
+	return nil
+}
+
+// Messages returns the last messages of the topic, or of all the topics if empty
+func (broker *MemoryBroker) Messages(topic string, limit int) []*Message {
+	broker.mux.RLock()
+	defer broker.mux.RUnlock()
+	output := make([]*Message, 0)
+	for i := len(broker.messages) - 1; i >= 0 && (limit <= 0 || len(output) < limit); i-- {
+		if len(topic) == 0 || broker.messages[i].Topic == topic {
+			output = append(output, broker.messages[i])
+		}
+	}
+	for i, j := 0, len(output)-1; i < j; i, j = i+1, j-1 {
+		output[i], output[j] = output[j], output[i]
+	}
+	return output
+}
+
+func (broker *MemoryBroker) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 0
+	if val := req.URL.Query().Get("limit"); len(val) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(val); err != nil {
+			http.Error(resp, "invalid limit "+val, http.StatusBadRequest)
+			return
+		}
+	}
+	utils.WriteJSON(resp, req, broker.Messages(req.URL.Query().Get("topic"), limit))
+}
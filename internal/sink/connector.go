@@ -0,0 +1,91 @@
+package sink
+
+import (
+	"encoding/json"
+	poller "github.com/IRT-SystemX/bcm-poller/poller"
+	"log"
+)
+
+const (
+	BLOCK  = "block"
+	TX     = "tx"
+	REVERT = "revert"
+)
+
+// Block is implemented by the block events of the eth and hlf processors
+type Block interface {
+	poller.BlockEvent
+	Hash() string
+	ParentHash() string
+	Timestamp() uint64
+	Txs() []interface{}
+}
+
+// message published for every block, transaction and revert, whatever the chain
+type message struct {
+	Type         string      `json:"type"`
+	Chain        string      `json:"chain"`
+	Number       string      `json:"block"`
+	Hash         string      `json:"hash"`
+	ParentHash   string      `json:"parentHash,omitempty"`
+	Timestamp    uint64      `json:"timestamp"`
+	Transactions int         `json:"transactions,omitempty"`
+	Index        *int        `json:"index,omitempty"`
+	Data         interface{} `json:"data,omitempty"`
+}
+
+// Connector publishes the blocks, the transactions and the reverts to a broker on the topics {chain}.blocks, {chain}.txs
+// and {chain}.reverts, keyed by block number
+type Connector struct {
+	broker Broker
+	chain  string
+	poller.Connector
+}
+
+func NewConnector(broker Broker, chain string) *Connector {
+	return &Connector{broker: broker, chain: chain}
+}
+
+func (connector *Connector) publish(topic string, msg *message) {
+	value, err := json.Marshal(msg)
+	if err == nil {
+		err = connector.broker.Publish(connector.chain+"."+topic, msg.Number, value)
+	}
+	if err != nil {
+		log.Println("Error sink: ", err)
+	}
+}
+
+func (connector *Connector) header(kind string, block Block) *message {
+	return &message{Type: kind, Chain: connector.chain, Number: block.Number().String(), Hash: block.Hash(), Timestamp: block.Timestamp()}
+}
+
+func (connector *Connector) Apply(event interface{}) {
+	block := event.(Block)
+	txs := block.Txs()
+	msg := connector.header(BLOCK, block)
+	msg.ParentHash = block.ParentHash()
+	msg.Transactions = len(txs)
+	connector.publish("blocks", msg)
+	for i, tx := range txs {
+		msg := connector.header(TX, block)
+		index := i
+		msg.Index = &index
+		msg.Data = tx
+		connector.publish("txs", msg)
+	}
+}
+
+func (connector *Connector) Revert(event interface{}) {
+	block := event.(Block)
+	msg := connector.header(REVERT, block)
+	msg.Transactions = len(block.Txs())
+	connector.publish("reverts", msg)
+}
+
+func (connector *Connector) SetReady() {
+}
+
+func (connector *Connector) Close() error {
+	return connector.broker.Close()
+}
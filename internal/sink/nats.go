@@ -0,0 +1,319 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// timeout of the connection, of the handshake with the server and of the writes
+	natsTimeout = 10 * time.Second
+	// delay between the connections to the server, doubled up to natsMaxBackoff while it is unreachable
+	natsBackoff    = 500 * time.Millisecond
+	natsMaxBackoff = 30 * time.Second
+)
+
+// number of messages buffered while the server is unreachable, the oldest ones being dropped beyond
+var natsMaxPending = 10000
+
+type natsInfo struct {
+	Headers bool `json:"headers"`
+}
+
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+	Protocol int    `json:"protocol"`
+	Headers  bool   `json:"headers"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Token    string `json:"auth_token,omitempty"`
+}
+
+type natsRecord struct {
+	topic string
+	key   string
+	value []byte
+}
+
+type natsStatus struct {
+	Connected bool `json:"connected"`
+	Pending   int  `json:"pending"`
+	Dropped   int  `json:"dropped"`
+}
+
+// NatsBroker publishes the messages to a NATS server, the topic being the subject and the key a header of the message
+// when the server supports the headers: the messages are buffered and written from its own goroutine, which
+// reconnects to the server as soon as the connection is lost and sends the messages not flushed again
+type NatsBroker struct {
+	mux     sync.Mutex
+	cond    *sync.Cond
+	address string
+	connect *natsConnect
+	conn    net.Conn
+	writer  *bufio.Writer
+	headers bool
+	err     error
+	pending []*natsRecord
+	dropped int
+	closed  bool
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// NewNatsBroker connects to nats://[user:pass@|token@]host:port
+func NewNatsBroker(raw string) (*NatsBroker, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Host) == 0 {
+		return nil, errors.New("missing host in " + raw)
+	}
+	address := u.Host
+	if len(u.Port()) == 0 {
+		address = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	connect := &natsConnect{Name: "bcm-poller", Lang: "go", Version: "1.0", Protocol: 1, Headers: true}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			connect.User, connect.Pass = u.User.Username(), pass
+		} else {
+			connect.Token = u.User.Username()
+		}
+	}
+	broker := &NatsBroker{address: address, connect: connect, pending: make([]*natsRecord, 0), closing: make(chan struct{}), done: make(chan struct{})}
+	broker.cond = sync.NewCond(&broker.mux)
+	conn, reader, headers, err := broker.dial()
+	if err != nil {
+		return nil, err
+	}
+	broker.attach(conn, reader, headers)
+	go broker.loop()
+	return broker, nil
+}
+
+// dial connects and waits for the PONG of the server, which answers an -ERR if the CONNECT is rejected
+func (broker *NatsBroker) dial() (net.Conn, *bufio.Reader, bool, error) {
+	conn, err := net.DialTimeout("tcp", broker.address, natsTimeout)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, false, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, nil, false, errors.New("unexpected nats greeting " + strings.TrimSpace(line))
+	}
+	info := &natsInfo{}
+	if err = json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), info); err != nil {
+		conn.Close()
+		return nil, nil, false, err
+	}
+	connect, _ := json.Marshal(broker.connect)
+	if _, err = fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		conn.Close()
+		return nil, nil, false, err
+	}
+	for {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, nil, false, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, nil, false, errors.New("nats " + line)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reader, info.Headers, nil
+}
+
+// attach uses the connection under the lock
+func (broker *NatsBroker) attach(conn net.Conn, reader *bufio.Reader, headers bool) {
+	if broker.closed {
+		conn.Close()
+		return
+	}
+	broker.conn = conn
+	broker.writer = bufio.NewWriter(conn)
+	broker.headers = headers
+	broker.err = nil
+	go broker.read(conn, reader)
+}
+
+func (broker *NatsBroker) disconnect() {
+	if broker.conn != nil {
+		broker.conn.Close()
+		broker.conn = nil
+	}
+	broker.err = nil
+}
+
+// read answers the PINGs of the server and keeps its errors, the connection being replaced by the loop
+func (broker *NatsBroker) read(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		broker.mux.Lock()
+		if broker.conn != conn {
+			broker.mux.Unlock()
+			return
+		}
+		if err != nil {
+			broker.err = err
+			broker.cond.Signal()
+			broker.mux.Unlock()
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			broker.writer.WriteString("PONG\r\n")
+			broker.writer.Flush()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Println("Error nats: ", line)
+			broker.err = errors.New("nats " + line)
+			broker.cond.Signal()
+		}
+		broker.mux.Unlock()
+	}
+}
+
+// loop writes the messages buffered, reconnecting to the server with a backoff when the connection is lost, the
+// messages being removed from the buffer once flushed
+func (broker *NatsBroker) loop() {
+	defer close(broker.done)
+	backoff := natsBackoff
+	broker.mux.Lock()
+	defer broker.mux.Unlock()
+	for {
+		for !broker.closed && len(broker.pending) == 0 && broker.conn != nil && broker.err == nil {
+			broker.cond.Wait()
+		}
+		if broker.closed && len(broker.pending) == 0 {
+			return
+		}
+		if broker.conn == nil || broker.err != nil {
+			if broker.err != nil {
+				log.Println("Error nats: ", broker.err)
+			}
+			broker.disconnect()
+			broker.mux.Unlock()
+			conn, reader, headers, err := broker.dial()
+			if err != nil {
+				log.Println("Error nats: ", err)
+				select {
+				case <-time.After(backoff):
+				case <-broker.closing:
+				}
+				if backoff *= 2; backoff > natsMaxBackoff {
+					backoff = natsMaxBackoff
+				}
+			}
+			broker.mux.Lock()
+			if err != nil {
+				if broker.closed {
+					return
+				}
+				continue
+			}
+			backoff = natsBackoff
+			broker.attach(conn, reader, headers)
+			log.Printf("Sink reconnected to nats://%s with %d messages pending", broker.address, len(broker.pending))
+			continue
+		}
+		broker.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+		for _, record := range broker.pending {
+			if broker.headers {
+				header := "NATS/1.0\r\nKey: " + record.key + "\r\n\r\n"
+				fmt.Fprintf(broker.writer, "HPUB %s %d %d\r\n%s", record.topic, len(header), len(header)+len(record.value), header)
+			} else {
+				fmt.Fprintf(broker.writer, "PUB %s %d\r\n", record.topic, len(record.value))
+			}
+			broker.writer.Write(record.value)
+			broker.writer.WriteString("\r\n")
+		}
+		if err := broker.writer.Flush(); err != nil {
+			broker.err = err
+			continue
+		}
+		broker.pending = broker.pending[:0]
+	}
+}
+
+// Publish buffers the message for the loop, dropping the oldest message when the buffer is full
+func (broker *NatsBroker) Publish(topic string, key string, value []byte) error {
+	broker.mux.Lock()
+	defer broker.mux.Unlock()
+	if broker.closed {
+		return errors.New("nats broker closed")
+	}
+	if len(broker.pending) >= natsMaxPending {
+		broker.pending[0] = nil
+		broker.pending = broker.pending[1:]
+		if broker.dropped++; broker.dropped%natsMaxPending == 1 {
+			log.Printf("Error nats: %d messages dropped, nats://%s unreachable", broker.dropped, broker.address)
+		}
+	}
+	broker.pending = append(broker.pending, &natsRecord{topic: topic, key: key, value: value})
+	broker.cond.Signal()
+	return nil
+}
+
+// MarshalJSON gives the state of the broker in the sink of /status
+func (broker *NatsBroker) MarshalJSON() ([]byte, error) {
+	broker.mux.Lock()
+	status := &natsStatus{Connected: broker.conn != nil && broker.err == nil, Pending: len(broker.pending), Dropped: broker.dropped}
+	broker.mux.Unlock()
+	return json.Marshal(status)
+}
+
+// Close flushes the messages buffered, those still pending after natsTimeout being dropped
+func (broker *NatsBroker) Close() error {
+	broker.mux.Lock()
+	if broker.closed {
+		broker.mux.Unlock()
+		return nil
+	}
+	broker.closed = true
+	broker.cond.Broadcast()
+	broker.mux.Unlock()
+	close(broker.closing)
+	select {
+	case <-broker.done:
+	case <-time.After(natsTimeout):
+	}
+	broker.mux.Lock()
+	defer broker.mux.Unlock()
+	if len(broker.pending) > 0 {
+		broker.dropped += len(broker.pending)
+		log.Printf("Error nats: %d messages dropped on close", len(broker.pending))
+		broker.pending = broker.pending[:0]
+	}
+	if broker.writer != nil && broker.conn != nil {
+		broker.writer.Flush()
+	}
+	broker.disconnect()
+	return nil
+}
@@ -0,0 +1,168 @@
+package sink
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type natsMessage struct {
+	subject string
+	header  string
+	payload string
+}
+
+// natsServer accepts one connection at a time and sends the messages published on it
+func natsServer(t *testing.T, headers bool) (string, chan *natsMessage, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveNats(t, listener, headers)
+}
+
+func serveNats(t *testing.T, listener net.Listener, headers bool) (string, chan *natsMessage, chan string) {
+	messages, connects := make(chan *natsMessage, 100), make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"headers\":%t}\r\n", headers)
+			reader := bufio.NewReader(conn)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					break
+				}
+				fields := strings.Fields(line)
+				switch fields[0] {
+				case "CONNECT":
+					connects <- strings.TrimSpace(strings.TrimPrefix(line, "CONNECT"))
+				case "PING":
+					conn.Write([]byte("PONG\r\n"))
+				case "PUB", "HPUB":
+					size, _ := strconv.Atoi(fields[len(fields)-1])
+					data := make([]byte, size+2)
+					io.ReadFull(reader, data)
+					msg := &natsMessage{subject: fields[1], payload: string(data[:size])}
+					if fields[0] == "HPUB" {
+						headerSize, _ := strconv.Atoi(fields[2])
+						msg.header, msg.payload = msg.payload[:headerSize], msg.payload[headerSize:]
+					}
+					messages <- msg
+				}
+			}
+			conn.Close()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String(), messages, connects
+}
+
+func TestNatsPublish(t *testing.T) {
+	for _, headers := range []bool{true, false} {
+		address, messages, connects := natsServer(t, headers)
+		broker, err := Open("nats://user:secret@" + address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if connect := <-connects; !strings.Contains(connect, `"user":"user"`) || !strings.Contains(connect, `"pass":"secret"`) {
+			t.Errorf("connect: %s", connect)
+		}
+		if err = broker.Publish("eth.blocks", "12", []byte(`{"block":"12"}`)); err != nil {
+			t.Fatal(err)
+		}
+		msg := <-messages
+		if msg.subject != "eth.blocks" || msg.payload != `{"block":"12"}` {
+			t.Errorf("message: %+v", msg)
+		}
+		if headers && msg.header != "NATS/1.0\r\nKey: 12\r\n\r\n" {
+			t.Errorf("header: %q", msg.header)
+		}
+		if !headers && len(msg.header) > 0 {
+			t.Errorf("header without headers support: %q", msg.header)
+		}
+		broker.Close()
+	}
+}
+
+func TestNatsReconnect(t *testing.T) {
+	address, messages, connects := natsServer(t, true)
+	broker, err := NewNatsBroker("nats://" + address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-connects
+	broker.mux.Lock()
+	broker.conn.Close()
+	broker.mux.Unlock()
+	// reconnected before any message
+	<-connects
+	if err = broker.Publish("eth.txs", "1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-messages; msg.subject != "eth.txs" {
+		t.Errorf("message after reconnect: %+v", msg)
+	}
+	broker.Close()
+}
+
+func TestNatsBuffer(t *testing.T) {
+	natsMaxPending = 3
+	defer func() {
+		natsMaxPending = 10000
+	}()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, _, connects := serveNats(t, listener, true)
+	broker, err := NewNatsBroker("nats://" + address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-connects
+	// the server goes down with the connection
+	listener.Close()
+	broker.mux.Lock()
+	broker.conn.Close()
+	broker.mux.Unlock()
+	for i := 1; i <= 5; i++ {
+		if err = broker.Publish("eth.blocks", strconv.Itoa(i), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	broker.mux.Lock()
+	if len(broker.pending) != 3 || broker.dropped != 2 {
+		t.Errorf("got %d pending and %d dropped, want 3 and 2", len(broker.pending), broker.dropped)
+	}
+	broker.mux.Unlock()
+
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Skip("address not available again: ", err)
+	}
+	_, messages, _ := serveNats(t, listener, true)
+	for i := 3; i <= 5; i++ {
+		if msg := <-messages; msg.payload != strconv.Itoa(i) {
+			t.Errorf("message %d: %+v", i, msg)
+		}
+	}
+	broker.Close()
+	status, _ := broker.MarshalJSON()
+	if string(status) != `{"connected":false,"pending":0,"dropped":2}` {
+		t.Errorf("status after close: %s", status)
+	}
+}
+
+func TestNatsRejected(t *testing.T) {
+	if _, err := Open("nats://127.0.0.1:1"); err == nil {
+		t.Error("expecting a connection error")
+	}
+}
@@ -0,0 +1,532 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	metrics "github.com/IRT-SystemX/bcm-poller/internal/metrics"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultLimit int = 100
+	blocksFile       = "blocks.dat"
+	txsFile          = "txs.log"
+	// magic (8) + number of the first block (8), the records following from this block
+	blocksMagic       = "bcmblk01"
+	headerSize  int64 = 16
+	// flags (1) + timestamp (8) + hash (32) + parent hash (32)
+	recordSize int64 = 73
+	present    byte  = 1
+	prefixed   byte  = 2
+)
+
+// size of the reverted records from which the transaction log is compacted, once they are half of it
+var compactSize int64 = 1 << 20
+
+type Block struct {
+	Number     string `json:"number"`
+	Hash       string `json:"hash"`
+	ParentHash string `json:"parentHash"`
+	Timestamp  uint64 `json:"timestamp"`
+}
+
+type Tx struct {
+	Label     string          `json:"label"`
+	Number    string          `json:"block"`
+	Hash      string          `json:"blockHash"`
+	Timestamp uint64          `json:"timestamp"`
+	Data      json.RawMessage `json:"tx"`
+}
+
+// a line of the transaction log, either a matched transaction or the revert of a block
+type entry struct {
+	*Tx
+	Revert string `json:"revert,omitempty"`
+}
+
+type txIndex struct {
+	number *big.Int
+	offset int64
+	length int64
+}
+
+type Store struct {
+	mux    sync.RWMutex
+	path   string
+	blocks *os.File
+	base   *big.Int
+	txs    *os.File
+	size   int64
+	dead   int64
+	index  map[string][]*txIndex
+}
+
+func Open(path string) (*Store, error) {
+	err := os.MkdirAll(path, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := os.OpenFile(filepath.Join(path, blocksFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := os.OpenFile(filepath.Join(path, txsFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		blocks.Close()
+		return nil, err
+	}
+	store := &Store{path: path, blocks: blocks, txs: txs, index: make(map[string][]*txIndex)}
+	if err = store.readHeader(); err == nil {
+		err = store.load()
+	}
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	log.Printf("Store opened %s", path)
+	return store, nil
+}
+
+// load replays the transaction log to rebuild the index
+func (store *Store) load() error {
+	reader := bufio.NewReader(store.txs)
+	var offset int64 = 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Store drops truncated record at %d", offset)
+				if err = store.txs.Truncate(offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var record entry
+		if err = json.Unmarshal(line, &record); err != nil {
+			return errors.New("Error reading store at " + big.NewInt(offset).String() + ": " + err.Error())
+		}
+		if len(record.Revert) > 0 {
+			number, _ := new(big.Int).SetString(record.Revert, 10)
+			store.dead += store.dropIndex(number) + int64(len(line))
+		} else if record.Tx != nil {
+			number, _ := new(big.Int).SetString(record.Number, 10)
+			store.addIndex(record.Label, &txIndex{number: number, offset: offset, length: int64(len(line))})
+		}
+		offset += int64(len(line))
+	}
+	store.size = offset
+	if _, err := store.txs.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	return store.compact()
+}
+
+func syncDir(path string) {
+	if dir, err := os.Open(path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
+
+// replace renames the temporary file over the file of the store once synced to disk
+func (store *Store) replace(tmp *os.File, name string, err error) error {
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(store.path, name))
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	syncDir(store.path)
+	return nil
+}
+
+// compact rewrites the transaction log without the transactions reverted and the reverts, once they are more than
+// compactSize and half of the log
+func (store *Store) compact() error {
+	if store.dead < compactSize || store.dead*2 < store.size {
+		return nil
+	}
+	indexes := make([]*txIndex, 0)
+	for _, entries := range store.index {
+		indexes = append(indexes, entries...)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i].offset < indexes[j].offset
+	})
+	tmp, err := os.OpenFile(filepath.Join(store.path, txsFile+".tmp"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	offsets := make([]int64, len(indexes))
+	var size int64 = 0
+	for i, index := range indexes {
+		offsets[i] = size
+		if _, err = io.Copy(writer, io.NewSectionReader(store.txs, index.offset, index.length)); err != nil {
+			break
+		}
+		size += index.length
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err = store.replace(tmp, txsFile, err); err != nil {
+		return err
+	}
+	store.txs.Close()
+	store.txs = tmp
+	for i, index := range indexes {
+		index.offset = offsets[i]
+	}
+	log.Printf("Store compacted %s from %d to %d bytes", txsFile, store.size, size)
+	store.size, store.dead = size, 0
+	return nil
+}
+
+func (store *Store) Close() error {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	store.txs.Sync()
+	store.blocks.Sync()
+	store.txs.Close()
+	return store.blocks.Close()
+}
+
+func decodeHash(value string) ([]byte, byte) {
+	var flags byte = 0
+	if strings.HasPrefix(value, "0x") {
+		flags = prefixed
+	}
+	buf := make([]byte, 32)
+	raw, err := hex.DecodeString(strings.TrimPrefix(value, "0x"))
+	if err == nil {
+		copy(buf, raw)
+	}
+	return buf, flags
+}
+
+func encodeHash(buf []byte, flags byte) string {
+	if flags&prefixed != 0 {
+		return "0x" + hex.EncodeToString(buf)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func writeHeader(file *os.File, base *big.Int) error {
+	header := make([]byte, headerSize)
+	copy(header, blocksMagic)
+	binary.BigEndian.PutUint64(header[8:], base.Uint64())
+	_, err := file.WriteAt(header, 0)
+	return err
+}
+
+// readHeader reads the first block of blocks.dat, none while empty
+func (store *Store) readHeader() error {
+	header := make([]byte, headerSize)
+	n, err := store.blocks.ReadAt(header, 0)
+	if n == 0 && err == io.EOF {
+		return nil
+	}
+	if err != nil || string(header[:8]) != blocksMagic {
+		return errors.New("Unknown format of " + filepath.Join(store.path, blocksFile) + ": remove the store to rebuild it")
+	}
+	store.base = new(big.Int).SetUint64(binary.BigEndian.Uint64(header[8:]))
+	return nil
+}
+
+func (store *Store) offset(number *big.Int) (int64, bool) {
+	if store.base == nil || number.Cmp(store.base) < 0 {
+		return 0, false
+	}
+	return headerSize + new(big.Int).Sub(number, store.base).Int64()*recordSize, true
+}
+
+// rebase moves the first block of blocks.dat down to the number, and at least by the number of blocks already
+// recorded so that the blocks of a fast sync applied below the first one only copy the file a few times
+func (store *Store) rebase(number *big.Int) error {
+	info, err := store.blocks.Stat()
+	if err != nil {
+		return err
+	}
+	base := new(big.Int).Sub(store.base, big.NewInt((info.Size()-headerSize)/recordSize))
+	if base.Cmp(number) > 0 {
+		base = number
+	}
+	if base.Sign() < 0 {
+		base = big.NewInt(0)
+	}
+	tmp, err := os.OpenFile(filepath.Join(store.path, blocksFile+".tmp"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = writeHeader(tmp, base)
+	if err == nil {
+		_, err = tmp.Seek(headerSize+new(big.Int).Sub(store.base, base).Int64()*recordSize, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(tmp, io.NewSectionReader(store.blocks, headerSize, info.Size()-headerSize))
+	}
+	if err = store.replace(tmp, blocksFile, err); err != nil {
+		return err
+	}
+	store.blocks.Close()
+	store.blocks = tmp
+	store.base = base
+	return nil
+}
+
+func (store *Store) writeBlock(number *big.Int, record []byte) error {
+	if store.base == nil {
+		if err := writeHeader(store.blocks, number); err != nil {
+			return err
+		}
+		store.base = new(big.Int).Set(number)
+	} else if number.Cmp(store.base) < 0 {
+		if err := store.rebase(number); err != nil {
+			return err
+		}
+	}
+	offset, _ := store.offset(number)
+	_, err := store.blocks.WriteAt(record, offset)
+	return err
+}
+
+func (store *Store) putBlock(notification *metrics.Notification, number *big.Int) error {
+	record := make([]byte, recordSize)
+	hash, flags := decodeHash(notification.Hash)
+	parentHash, _ := decodeHash(notification.ParentHash)
+	record[0] = present | flags
+	binary.BigEndian.PutUint64(record[1:9], notification.Timestamp)
+	copy(record[9:41], hash)
+	copy(record[41:73], parentHash)
+	return store.writeBlock(number, record)
+}
+
+func (store *Store) readBlock(number *big.Int) (*Block, error) {
+	offset, ok := store.offset(number)
+	if !ok {
+		return nil, nil
+	}
+	record := make([]byte, recordSize)
+	_, err := store.blocks.ReadAt(record, offset)
+	if err == io.EOF || (err == nil && record[0]&present == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Block{
+		Number:     number.String(),
+		Timestamp:  binary.BigEndian.Uint64(record[1:9]),
+		Hash:       encodeHash(record[9:41], record[0]),
+		ParentHash: encodeHash(record[41:73], record[0]),
+	}, nil
+}
+
+func (store *Store) Block(number *big.Int) (*Block, error) {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	return store.readBlock(number)
+}
+
+// Hash returns the hash of the block recorded at this number, empty if none
+func (store *Store) Hash(number *big.Int) (string, error) {
+	block, err := store.Block(number)
+	if err != nil || block == nil {
+		return "", err
+	}
+	return block.Hash, nil
+}
+
+func (store *Store) append(record *entry) (int64, int64, error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return 0, 0, err
+	}
+	line = append(line, '\n')
+	offset := store.size
+	if _, err = store.txs.Write(line); err != nil {
+		return 0, 0, err
+	}
+	store.size += int64(len(line))
+	return offset, int64(len(line)), nil
+}
+
+// addIndex keeps the index sorted by block number, the blocks of a fast sync being applied out of order, and the
+// transactions of a block in order
+func (store *Store) addIndex(label string, index *txIndex) {
+	entries := store.index[label]
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].number.Cmp(index.number) > 0
+	})
+	entries = append(entries, nil)
+	copy(entries[i+1:], entries[i:])
+	entries[i] = index
+	store.index[label] = entries
+}
+
+// dropIndex returns the size of the transactions dropped from the log
+func (store *Store) dropIndex(number *big.Int) int64 {
+	var size int64 = 0
+	for label, entries := range store.index {
+		i := sort.Search(len(entries), func(i int) bool {
+			return entries[i].number.Cmp(number) >= 0
+		})
+		j := i
+		for j < len(entries) && entries[j].number.Cmp(number) == 0 {
+			size += entries[j].length
+			j++
+		}
+		store.index[label] = append(entries[:i], entries[j:]...)
+	}
+	return size
+}
+
+// revert drops the block and the transactions recorded at this number
+func (store *Store) revert(number *big.Int) error {
+	if block, err := store.readBlock(number); err != nil || block != nil {
+		if err == nil {
+			err = store.writeBlock(number, make([]byte, recordSize))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	store.dead += store.dropIndex(number)
+	_, length, err := store.append(&entry{Revert: number.String()})
+	if err != nil {
+		return err
+	}
+	store.dead += length
+	return store.compact()
+}
+
+func (store *Store) Notify(notification *metrics.Notification) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	number, ok := new(big.Int).SetString(notification.Number, 10)
+	if !ok {
+		return
+	}
+	var err error
+	switch notification.Type {
+	case metrics.BLOCK:
+		var block *Block
+		block, err = store.readBlock(number)
+		if err == nil && block != nil {
+			// the block is applied again after a restore or a reorg
+			err = store.revert(number)
+		}
+		if err == nil {
+			err = store.putBlock(notification, number)
+		}
+	case metrics.DETECT:
+		var data []byte
+		data, err = json.Marshal(notification.Data)
+		if err == nil {
+			tx := &Tx{Label: notification.Label, Number: notification.Number, Hash: notification.Hash, Timestamp: notification.Timestamp, Data: data}
+			var offset, length int64
+			offset, length, err = store.append(&entry{Tx: tx})
+			if err == nil {
+				store.addIndex(tx.Label, &txIndex{number: number, offset: offset, length: length})
+			}
+		}
+	case metrics.REVERT:
+		err = store.revert(number)
+	}
+	if err != nil {
+		log.Println("Error store: ", err)
+	}
+}
+
+// Txs returns the transactions matching the event label between two block numbers (included)
+func (store *Store) Txs(label string, from *big.Int, to *big.Int, limit int) ([]*Tx, error) {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	entries := store.index[label]
+	start := sort.Search(len(entries), func(i int) bool {
+		return from == nil || entries[i].number.Cmp(from) >= 0
+	})
+	txs := make([]*Tx, 0)
+	for i := start; i < len(entries) && (to == nil || entries[i].number.Cmp(to) <= 0) && (limit <= 0 || len(txs) < limit); i++ {
+		line := make([]byte, entries[i].length)
+		if _, err := store.txs.ReadAt(line, entries[i].offset); err != nil {
+			return nil, err
+		}
+		var record entry
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, err
+		}
+		txs = append(txs, record.Tx)
+	}
+	return txs, nil
+}
+
+func parseNumber(value string) (*big.Int, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	number, ok := new(big.Int).SetString(value, 10)
+	if !ok {
+		return nil, errors.New("invalid block number " + value)
+	}
+	return number, nil
+}
+
+// ServeHTTP answers /events/{label}/txs?from=&to=&limit=
+func (store *Store) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(path) != 3 || path[0] != "events" || path[2] != "txs" {
+		http.NotFound(resp, req)
+		return
+	}
+	from, err := parseNumber(req.URL.Query().Get("from"))
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseNumber(req.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultLimit
+	if val := req.URL.Query().Get("limit"); len(val) > 0 {
+		if limit, err = strconv.Atoi(val); err != nil {
+			http.Error(resp, "invalid limit "+val, http.StatusBadRequest)
+			return
+		}
+	}
+	txs, err := store.Txs(path[1], from, to, limit)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.WriteJSON(resp, req, txs)
+}
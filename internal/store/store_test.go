@@ -0,0 +1,167 @@
+package store
+
+import (
+	"fmt"
+	metrics "github.com/IRT-SystemX/bcm-poller/internal/metrics"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func notify(store *Store, number int64, labels ...string) {
+	hash := fmt.Sprintf("0x%064x", number)
+	store.Notify(metrics.NewNotification(metrics.BLOCK, big.NewInt(number), hash, uint64(number)))
+	for i, label := range labels {
+		notification := metrics.NewNotification(metrics.DETECT, big.NewInt(number), hash, uint64(number))
+		notification.Label = label
+		notification.Data = map[string]int{"index": i}
+		store.Notify(notification)
+	}
+}
+
+func numbers(t *testing.T, store *Store, label string, from int64, to int64) []string {
+	txs, err := store.Txs(label, big.NewInt(from), big.NewInt(to), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := make([]string, len(txs))
+	for i, tx := range txs {
+		output[i] = tx.Number
+	}
+	return output
+}
+
+func check(t *testing.T, name string, got []string, want ...string) {
+	if len(got) != len(want) {
+		t.Errorf("%s: got %v, want %v", name, got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// blocks applied by the workers of a fast sync
+	for _, number := range []int64{7, 2, 9, 4, 2, 5, 8, 1} {
+		if number == 2 {
+			notify(store, number)
+			continue
+		}
+		notify(store, number, "transfer", "transfer")
+	}
+	check(t, "all", numbers(t, store, "transfer", 0, 10), "1", "1", "4", "4", "5", "5", "7", "7", "8", "8", "9", "9")
+	check(t, "range", numbers(t, store, "transfer", 3, 7), "4", "4", "5", "5", "7", "7")
+	check(t, "one", numbers(t, store, "transfer", 8, 8), "8", "8")
+
+	store.Notify(metrics.NewNotification(metrics.REVERT, big.NewInt(5), fmt.Sprintf("0x%064x", 5), 5))
+	check(t, "revert", numbers(t, store, "transfer", 0, 10), "1", "1", "4", "4", "7", "7", "8", "8", "9", "9")
+	notify(store, 4, "transfer")
+	check(t, "applied again", numbers(t, store, "transfer", 0, 10), "1", "1", "4", "7", "7", "8", "8", "9", "9")
+	if block, _ := store.Block(big.NewInt(5)); block != nil {
+		t.Errorf("block reverted: %+v", block)
+	}
+	if block, _ := store.Block(big.NewInt(9)); block == nil || block.Hash != fmt.Sprintf("0x%064x", 9) {
+		t.Errorf("block 9: %+v", block)
+	}
+
+	store.Close()
+	store, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	check(t, "reopened", numbers(t, store, "transfer", 0, 10), "1", "1", "4", "7", "7", "8", "8", "9", "9")
+}
+
+func TestFirstBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, number := range []int64{20000000, 20000003, 19999998, 20000001, 19999990} {
+		notify(store, number)
+	}
+	store.Close()
+	info, err := os.Stat(filepath.Join(dir, blocksFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > headerSize+32*recordSize {
+		t.Errorf("got %d bytes for 14 blocks", info.Size())
+	}
+	store, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, number := range []int64{20000000, 20000003, 19999998, 20000001, 19999990} {
+		if block, _ := store.Block(big.NewInt(number)); block == nil || block.Hash != fmt.Sprintf("0x%064x", number) {
+			t.Errorf("block %d: %+v", number, block)
+		}
+	}
+	for _, number := range []int64{0, 19999989, 19999999, 20000002, 20000004} {
+		if block, _ := store.Block(big.NewInt(number)); block != nil {
+			t.Errorf("block %d not recorded: %+v", number, block)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	compactSize = 1024
+	defer func() {
+		compactSize = 1 << 20
+	}()
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify(store, 1, "transfer")
+	for i := 0; i < 20; i++ {
+		notify(store, 2, "transfer", "transfer")
+	}
+	notify(store, 3, "transfer")
+	check(t, "compacted", numbers(t, store, "transfer", 0, 10), "1", "2", "2", "3")
+	store.Close()
+	info, err := os.Stat(filepath.Join(dir, txsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 2048 {
+		t.Errorf("got %d bytes for 4 transactions", info.Size())
+	}
+	store, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	check(t, "reopened", numbers(t, store, "transfer", 0, 10), "1", "2", "2", "3")
+	txs, err := store.Txs("transfer", big.NewInt(2), big.NewInt(2), 0)
+	if err != nil || len(txs) != 2 || string(txs[0].Data) != `{"index":0}` || string(txs[1].Data) != `{"index":1}` {
+		t.Errorf("transactions of block 2 in order: %v %v", txs, err)
+	}
+}
@@ -0,0 +1,212 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	metrics "github.com/IRT-SystemX/bcm-poller/internal/metrics"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// messages buffered per client, a client falling behind is disconnected
+	bufferSize int = 256
+	keepAlive      = 15 * time.Second
+	writeWait      = 10 * time.Second
+)
+
+type message struct {
+	id    uint64
+	kind  metrics.NotificationType
+	label string
+	data  []byte
+}
+
+type client struct {
+	queue  chan *message
+	types  map[string]bool
+	labels map[string]bool
+}
+
+func newClient(req *http.Request) *client {
+	return &client{
+		queue:  make(chan *message, bufferSize),
+		types:  parseSet(req.URL.Query().Get("type")),
+		labels: parseSet(req.URL.Query().Get("label")),
+	}
+}
+
+func parseSet(value string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// revert and block messages are not labeled and always pass the label filter
+func (client *client) accept(msg *message) bool {
+	if len(client.types) > 0 && !client.types[string(msg.kind)] {
+		return false
+	}
+	return len(client.labels) == 0 || len(msg.label) == 0 || client.labels[msg.label]
+}
+
+// Hub pushes the notifications of the cache to the clients of /stream, over SSE or WebSocket
+type Hub struct {
+	mux      sync.Mutex
+	sequence uint64
+	clients  map[*client]bool
+	upgrader websocket.Upgrader
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		clients:  make(map[*client]bool),
+		upgrader: websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }},
+	}
+}
+
+func (hub *Hub) Notify(notification *metrics.Notification) {
+	hub.mux.Lock()
+	defer hub.mux.Unlock()
+	if len(hub.clients) == 0 {
+		return
+	}
+	data, err := json.Marshal(notification)
+	if err != nil {
+		log.Println("Error stream: ", err)
+		return
+	}
+	hub.sequence++
+	msg := &message{id: hub.sequence, kind: notification.Type, label: notification.Label, data: data}
+	for client := range hub.clients {
+		if !client.accept(msg) {
+			continue
+		}
+		select {
+		case client.queue <- msg:
+		default:
+			log.Println("Stream client too slow, disconnecting")
+			hub.drop(client)
+		}
+	}
+}
+
+func (hub *Hub) subscribe(client *client) {
+	hub.mux.Lock()
+	defer hub.mux.Unlock()
+	hub.clients[client] = true
+}
+
+func (hub *Hub) unsubscribe(client *client) {
+	hub.mux.Lock()
+	defer hub.mux.Unlock()
+	hub.drop(client)
+}
+
+func (hub *Hub) drop(client *client) {
+	if hub.clients[client] {
+		delete(hub.clients, client)
+		close(client.queue)
+	}
+}
+
+// ServeHTTP answers /stream?type=event,revert&label=..., upgraded to WebSocket when requested and SSE otherwise
+func (hub *Hub) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if websocket.IsWebSocketUpgrade(req) {
+		hub.serveWebSocket(resp, req)
+	} else {
+		hub.serveEvents(resp, req)
+	}
+}
+
+func (hub *Hub) serveEvents(resp http.ResponseWriter, req *http.Request) {
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		http.Error(resp, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	client := newClient(req)
+	hub.subscribe(client)
+	defer hub.unsubscribe(client)
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-client.queue:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(resp, "id: %d\nevent: %s\ndata: %s\n\n", msg.id, msg.kind, msg.data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(resp, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func (hub *Hub) serveWebSocket(resp http.ResponseWriter, req *http.Request) {
+	conn, err := hub.upgrader.Upgrade(resp, req, nil)
+	if err != nil {
+		log.Println("Error stream: ", err)
+		return
+	}
+	defer conn.Close()
+	client := newClient(req)
+	hub.subscribe(client)
+	defer hub.unsubscribe(client)
+	closed := make(chan struct{})
+	go func() {
+		// the messages of the client are ignored, reading only detects the close
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-client.queue:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"), time.Now().Add(writeWait))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.TextMessage, msg.data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	backup "github.com/IRT-SystemX/bcm-poller/internal/backup"
+	metrics "github.com/IRT-SystemX/bcm-poller/internal/metrics"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT    = "event"
+	REVERTED = "reverted"
+	// a delivery is moved to the dead letters after this number of failed attempts, a few minutes, so that it does
+	// not hold the next deliveries of the webhook back for long
+	maxAttempts int = 8
+	maxBackoff      = time.Minute
+	// deliveries kept after being sent, to compensate them on a reorg, and after failing
+	maxSent int = 1024
+	maxDead int = 1024
+	idle        = time.Hour
+	// the changes of the outbox are written at most once in this delay
+	saveDelay = time.Second
+)
+
+type Delivery struct {
+	Id       string          `json:"id"`
+	Webhook  string          `json:"webhook"`
+	Type     string          `json:"type"`
+	Block    string          `json:"block"`
+	Payload  json.RawMessage `json:"payload"`
+	Attempts int             `json:"attempts"`
+	Next     time.Time       `json:"next"`
+	inflight bool
+	reverted bool
+}
+
+type payload struct {
+	Id      string `json:"id"`
+	Webhook string `json:"webhook"`
+	*metrics.Notification
+}
+
+// the outbox file holds the deliveries to send, the last ones sent and the last ones failing
+type outbox struct {
+	Pending []*Delivery `json:"pending"`
+	Sent    []*Delivery `json:"sent"`
+	Dead    []*Delivery `json:"dead"`
+}
+
+// Dispatcher posts the detected events to the webhooks from a durable outbox, with retries
+type Dispatcher struct {
+	mux      sync.Mutex
+	path     string
+	webhooks map[string]*Webhook
+	wake     map[string]chan struct{}
+	client   *http.Client
+	live     func() bool
+	skipped  int
+	dirty    bool
+	saving   chan struct{}
+	writeMux sync.Mutex
+	outbox
+}
+
+func newId() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func NewDispatcher(webhooks []*Webhook, path string) (*Dispatcher, error) {
+	dispatcher := &Dispatcher{
+		path:     path,
+		webhooks: make(map[string]*Webhook),
+		wake:     make(map[string]chan struct{}),
+		client:   &http.Client{Timeout: timeout},
+		saving:   make(chan struct{}, 1),
+		outbox:   outbox{Pending: make([]*Delivery, 0), Sent: make([]*Delivery, 0), Dead: make([]*Delivery, 0)},
+	}
+	for _, webhook := range webhooks {
+		dispatcher.webhooks[webhook.Name] = webhook
+		dispatcher.wake[webhook.Name] = make(chan struct{}, 1)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var saved outbox
+		if err = json.Unmarshal(data, &saved); err != nil {
+			return nil, err
+		}
+		for _, delivery := range saved.Pending {
+			if _, ok := dispatcher.webhooks[delivery.Webhook]; ok {
+				dispatcher.Pending = append(dispatcher.Pending, delivery)
+			} else {
+				log.Printf("Webhook %s is not configured anymore, dropping delivery %s", delivery.Webhook, delivery.Id)
+			}
+		}
+		dispatcher.Sent = append(dispatcher.Sent, saved.Sent...)
+		dispatcher.Dead = append(dispatcher.Dead, saved.Dead...)
+		log.Printf("Webhook outbox restored with %d pending deliveries", len(dispatcher.Pending))
+	}
+	return dispatcher, nil
+}
+
+// SetLive only posts the events detected once live() is true, the events of the past blocks synced being skipped
+func (dispatcher *Dispatcher) SetLive(live func() bool) {
+	dispatcher.live = live
+}
+
+func (dispatcher *Dispatcher) Start() {
+	go func() {
+		for range dispatcher.saving {
+			time.Sleep(saveDelay)
+			dispatcher.flush()
+		}
+	}()
+	for _, webhook := range dispatcher.webhooks {
+		go dispatcher.work(webhook)
+	}
+}
+
+// save marks the outbox to be written by the saving loop, with the other changes of the delay
+func (dispatcher *Dispatcher) save() {
+	dispatcher.dirty = true
+	select {
+	case dispatcher.saving <- struct{}{}:
+	default:
+	}
+}
+
+// flush writes the outbox if it changed in a temporary file synced to disk, then renamed over the previous one,
+// outside of the lock
+func (dispatcher *Dispatcher) flush() {
+	dispatcher.writeMux.Lock()
+	defer dispatcher.writeMux.Unlock()
+	dispatcher.mux.Lock()
+	if !dispatcher.dirty {
+		dispatcher.mux.Unlock()
+		return
+	}
+	data, err := json.Marshal(dispatcher.outbox)
+	dispatcher.dirty = false
+	dispatcher.mux.Unlock()
+	if err == nil {
+		err = backup.NewFileStore().Write(dispatcher.path, data)
+	}
+	if err != nil {
+		log.Println("Error webhook outbox: ", err)
+	}
+}
+
+// Close writes the changes of the outbox not written yet
+func (dispatcher *Dispatcher) Close() {
+	dispatcher.flush()
+}
+
+func (dispatcher *Dispatcher) signal(name string) {
+	select {
+	case dispatcher.wake[name] <- struct{}{}:
+	default:
+	}
+}
+
+func (dispatcher *Dispatcher) Notify(notification *metrics.Notification) {
+	dispatcher.mux.Lock()
+	defer dispatcher.mux.Unlock()
+	switch notification.Type {
+	case metrics.DETECT:
+		if dispatcher.live != nil && !dispatcher.live() {
+			dispatcher.skipped++
+			return
+		}
+		if dispatcher.skipped > 0 {
+			log.Printf("Webhooks skipped %d events detected while syncing", dispatcher.skipped)
+			dispatcher.skipped = 0
+		}
+		for _, webhook := range dispatcher.webhooks {
+			if !webhook.accept(notification.Label) {
+				continue
+			}
+			id := newId()
+			data, err := json.Marshal(&payload{Id: id, Webhook: webhook.Name, Notification: notification})
+			if err != nil {
+				log.Println("Error webhook: ", err)
+				continue
+			}
+			dispatcher.Pending = append(dispatcher.Pending, &Delivery{Id: id, Webhook: webhook.Name, Type: EVENT, Block: notification.Number, Payload: data, Next: time.Now()})
+			dispatcher.signal(webhook.Name)
+		}
+	case metrics.REVERT:
+		dispatcher.revert(notification.Number)
+	default:
+		return
+	}
+	dispatcher.save()
+}
+
+// revert cancels the deliveries of the block not sent yet and compensates the others
+func (dispatcher *Dispatcher) revert(number string) {
+	compensate := make([]*Delivery, 0)
+	pending := make([]*Delivery, 0, len(dispatcher.Pending))
+	for _, delivery := range dispatcher.Pending {
+		if delivery.Type == EVENT && delivery.Block == number {
+			if !delivery.inflight {
+				log.Printf("Webhook %s cancels delivery %s of reverted block #%s", delivery.Webhook, delivery.Id, number)
+				continue
+			}
+			delivery.reverted = true
+			compensate = append(compensate, delivery)
+		}
+		pending = append(pending, delivery)
+	}
+	sent := make([]*Delivery, 0, len(dispatcher.Sent))
+	for _, delivery := range dispatcher.Sent {
+		if delivery.Block == number {
+			compensate = append(compensate, delivery)
+		} else {
+			sent = append(sent, delivery)
+		}
+	}
+	dispatcher.Pending, dispatcher.Sent = pending, sent
+	for _, delivery := range compensate {
+		var body map[string]interface{}
+		if err := json.Unmarshal(delivery.Payload, &body); err != nil {
+			log.Println("Error webhook: ", err)
+			continue
+		}
+		id := newId()
+		body["reverts"] = body["id"]
+		body["id"] = id
+		body["type"] = REVERTED
+		data, _ := json.Marshal(body)
+		dispatcher.Pending = append(dispatcher.Pending, &Delivery{Id: id, Webhook: delivery.Webhook, Type: REVERTED, Block: number, Payload: data, Next: time.Now()})
+		dispatcher.signal(delivery.Webhook)
+	}
+}
+
+// next returns the first delivery of the webhook if it is due, or the time to wait for it
+func (dispatcher *Dispatcher) next(name string) (*Delivery, time.Duration) {
+	dispatcher.mux.Lock()
+	defer dispatcher.mux.Unlock()
+	for _, delivery := range dispatcher.Pending {
+		if delivery.Webhook == name {
+			if wait := time.Until(delivery.Next); wait > 0 {
+				return nil, wait
+			}
+			delivery.inflight = true
+			return delivery, 0
+		}
+	}
+	return nil, idle
+}
+
+func backoff(attempts int) time.Duration {
+	wait := time.Second << uint(attempts)
+	if wait <= 0 || wait > maxBackoff {
+		return maxBackoff
+	}
+	return wait
+}
+
+func (dispatcher *Dispatcher) done(delivery *Delivery, err error) {
+	dispatcher.mux.Lock()
+	defer dispatcher.mux.Unlock()
+	delivery.inflight = false
+	if err != nil {
+		delivery.Attempts++
+		if delivery.Attempts < maxAttempts {
+			delivery.Next = time.Now().Add(backoff(delivery.Attempts))
+			log.Printf("Error webhook %s delivery %s (attempt %d): %v", delivery.Webhook, delivery.Id, delivery.Attempts, err)
+			dispatcher.save()
+			return
+		}
+		log.Printf("Error webhook %s moves delivery %s to the dead letters after %d attempts: %v", delivery.Webhook, delivery.Id, delivery.Attempts, err)
+		if len(dispatcher.Dead) >= maxDead {
+			dispatcher.Dead = dispatcher.Dead[1:]
+		}
+		dispatcher.Dead = append(dispatcher.Dead, delivery)
+	} else if delivery.Type == EVENT && !delivery.reverted {
+		if len(dispatcher.Sent) >= maxSent {
+			dispatcher.Sent = dispatcher.Sent[1:]
+		}
+		dispatcher.Sent = append(dispatcher.Sent, delivery)
+	}
+	for i, x := range dispatcher.Pending {
+		if x == delivery {
+			dispatcher.Pending = append(dispatcher.Pending[:i], dispatcher.Pending[i+1:]...)
+			break
+		}
+	}
+	dispatcher.save()
+}
+
+// work sends the deliveries of a webhook one after the other, so that a revert always follows its event
+func (dispatcher *Dispatcher) work(webhook *Webhook) {
+	for {
+		delivery, wait := dispatcher.next(webhook.Name)
+		if delivery == nil {
+			select {
+			case <-dispatcher.wake[webhook.Name]:
+			case <-time.After(wait):
+			}
+			continue
+		}
+		dispatcher.done(delivery, webhook.send(dispatcher.client, delivery))
+	}
+}
@@ -0,0 +1,131 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const timeout = 10 * time.Second
+
+type Webhook struct {
+	Name    string
+	Url     string
+	Labels  map[string]bool
+	Headers map[string]string
+	Secret  string
+}
+
+func (webhook *Webhook) accept(label string) bool {
+	return len(webhook.Labels) == 0 || webhook.Labels[label]
+}
+
+func parseStrings(key string, value interface{}) ([]string, error) {
+	switch val := value.(type) {
+	case nil:
+		return []string{}, nil
+	case string:
+		return []string{val}, nil
+	case []interface{}:
+		output := make([]string, len(val))
+		for i, item := range val {
+			str, ok := item.(string)
+			if !ok {
+				return nil, errors.New("Error parsing webhook " + key + ": expecting a list of labels")
+			}
+			output[i] = str
+		}
+		return output, nil
+	}
+	return nil, errors.New("Error parsing webhook " + key + ": expecting a label or a list of labels")
+}
+
+func parseWebhook(key string, value interface{}) (*Webhook, error) {
+	options, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("Error parsing webhook " + key + ": expecting url, labels, headers and secret")
+	}
+	webhook := &Webhook{Name: key, Labels: make(map[string]bool), Headers: make(map[string]string)}
+	if webhook.Url, ok = options["url"].(string); !ok || len(webhook.Url) == 0 {
+		return nil, errors.New("Error parsing webhook " + key + ": missing url")
+	}
+	labels, err := parseStrings(key, options["labels"])
+	if err != nil {
+		return nil, err
+	}
+	for _, label := range labels {
+		webhook.Labels[label] = true
+	}
+	if headers, ok := options["headers"].(map[interface{}]interface{}); ok {
+		for name, value := range headers {
+			switch value.(type) {
+			case string, int, int64, uint64, float64, bool:
+				webhook.Headers[fmt.Sprint(name)] = fmt.Sprint(value)
+			default:
+				return nil, errors.New("Error parsing webhook " + key + ": expecting a value for header " + fmt.Sprint(name))
+			}
+		}
+	} else if options["headers"] != nil {
+		return nil, errors.New("Error parsing webhook " + key + ": expecting a map of headers")
+	}
+	webhook.Secret, _ = options["secret"].(string)
+	return webhook, nil
+}
+
+func ParseWebhooks(raw map[interface{}]interface{}) ([]*Webhook, error) {
+	output := make([]*Webhook, 0)
+	if raw == nil || raw["webhooks"] == nil {
+		return output, nil
+	}
+	tab, ok := raw["webhooks"].(map[interface{}]interface{})
+	if !ok {
+		return nil, utils.NewError(utils.ErrConfig, errors.New("Error parsing webhooks: expecting a map of webhooks"))
+	}
+	for key, value := range tab {
+		webhook, err := parseWebhook(fmt.Sprint(key), value)
+		if err != nil {
+			return nil, utils.NewError(utils.ErrConfig, err)
+		}
+		output = append(output, webhook)
+	}
+	return output, nil
+}
+
+// Sign returns the hex HMAC-SHA256 of the body with the secret of the webhook
+func (webhook *Webhook) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (webhook *Webhook) send(client *http.Client, delivery *Delivery) error {
+	req, err := http.NewRequest("POST", webhook.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Poller-Delivery", delivery.Id)
+	req.Header.Set("X-Poller-Event", delivery.Type)
+	if len(webhook.Secret) > 0 {
+		req.Header.Set("X-Poller-Signature", "sha256="+webhook.Sign(delivery.Payload))
+	}
+	for name, value := range webhook.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("webhook " + webhook.Name + " answered " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
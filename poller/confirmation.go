@@ -0,0 +1,89 @@
+package ingest
+
+import (
+	"log"
+	"math/big"
+)
+
+// Pending is notified of the blocks entering and leaving the buffer of the confirmations
+type Pending interface {
+	Add(BlockEvent)
+	Remove(BlockEvent)
+}
+
+// confirmation holds the blocks back from the connectors until they are deep enough, or finalized
+type confirmation struct {
+	depth     *big.Int
+	finalizer Finalizer
+	finalized *big.Int
+	head      *big.Int
+	pending   []BlockEvent
+	observer  Pending
+}
+
+func newConfirmation(depth int, finalizer Finalizer, observer Pending) *confirmation {
+	return &confirmation{depth: big.NewInt(int64(depth)), finalizer: finalizer, finalized: big.NewInt(-1), head: big.NewInt(-1), pending: make([]BlockEvent, 0), observer: observer}
+}
+
+// bound returns the last confirmed block number
+func (confirmation *confirmation) bound(number *big.Int) *big.Int {
+	if confirmation.finalizer == nil {
+		return new(big.Int).Sub(confirmation.head, confirmation.depth)
+	}
+	if number.Cmp(confirmation.finalized) > 0 {
+		finalized, err := confirmation.finalizer.Finalized()
+		if err != nil {
+			log.Println("Error finalized block: ", err)
+		} else {
+			confirmation.finalized = finalized
+		}
+	}
+	return confirmation.finalized
+}
+
+// push returns the events to forward to the connectors: the blocks confirmed by the new block, or the revert of a block
+// already confirmed, the revert of a pending block only dropping it
+func (confirmation *confirmation) push(event BlockEvent) []BlockEvent {
+	if revert, ok := event.(*revertEvent); ok {
+		for i := len(confirmation.pending) - 1; i >= 0; i-- {
+			if confirmation.pending[i].Number().Cmp(revert.Number()) == 0 {
+				confirmation.remove(i)
+				if confirmation.observer != nil {
+					confirmation.observer.Remove(revert.BlockEvent)
+				}
+				return nil
+			}
+		}
+		log.Printf("Revert of confirmed block #%s", revert.Number().String())
+		return []BlockEvent{event}
+	}
+	confirmation.pending = append(confirmation.pending, event)
+	if confirmation.observer != nil {
+		confirmation.observer.Add(event)
+	}
+	if event.Number().Cmp(confirmation.head) > 0 {
+		confirmation.head = event.Number()
+	}
+	bound := confirmation.bound(event.Number())
+	confirmed := make([]BlockEvent, 0)
+	for i := 0; i < len(confirmation.pending); {
+		if confirmation.pending[i].Number().Cmp(bound) <= 0 {
+			confirmed = append(confirmed, confirmation.pending[i])
+			if confirmation.observer != nil {
+				confirmation.observer.Remove(confirmation.pending[i])
+			}
+			confirmation.remove(i)
+		} else {
+			i++
+		}
+	}
+	return confirmed
+}
+
+func (confirmation *confirmation) remove(i int) {
+	confirmation.pending = append(confirmation.pending[:i], confirmation.pending[i+1:]...)
+}
+
+func (confirmation *confirmation) size() int {
+	return len(confirmation.pending)
+}
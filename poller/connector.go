@@ -0,0 +1,149 @@
+package ingest
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+)
+
+// revertEvent goes through the queue of the engine so that a revert follows the blocks already queued
+type revertEvent struct {
+	BlockEvent
+}
+
+const (
+	// a full queue waits for the connector, holding the engine back
+	BLOCK = "block"
+	// a full queue drops the block for the connector, counted in dropped
+	DROP = "drop"
+)
+
+type connectorStatus struct {
+	Queued    int    `json:"queued"`
+	Capacity  int    `json:"capacity,omitempty"`
+	Dropped   int    `json:"dropped"`
+	Block     string `json:"block,omitempty"`
+	Lag       string `json:"lag,omitempty"`
+	Errors    int    `json:"errors"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// connectorQueue applies the blocks to a connector from its own goroutine, a slow or failing connector only
+// delaying itself
+type connectorQueue struct {
+	name      string
+	connector Connector
+	mux       sync.Mutex
+	cond      *sync.Cond
+	space     *sync.Cond
+	pending   []BlockEvent
+	capacity  int
+	overflow  string
+	dropped   int
+	current   *big.Int
+	errors    int
+	lastError string
+}
+
+func newConnectorQueue(name string, connector Connector, capacity int) *connectorQueue {
+	queue := &connectorQueue{name: name, connector: connector, pending: make([]BlockEvent, 0), capacity: capacity, overflow: BLOCK}
+	queue.cond = sync.NewCond(&queue.mux)
+	queue.space = sync.NewCond(&queue.mux)
+	return queue
+}
+
+func (queue *connectorQueue) full() bool {
+	return queue.capacity > 0 && len(queue.pending) >= queue.capacity
+}
+
+// push queues the block, a full queue either waiting for the connector or dropping the block by its overflow policy
+func (queue *connectorQueue) push(event BlockEvent) {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+	if queue.full() && queue.overflow == DROP {
+		queue.dropped++
+		log.Printf("Connector %s drops block #%s: %d blocks queued", queue.name, event.Number().String(), len(queue.pending))
+		return
+	}
+	for queue.full() {
+		queue.space.Wait()
+	}
+	queue.pending = append(queue.pending, event)
+	queue.cond.Signal()
+}
+
+func (queue *connectorQueue) pop() BlockEvent {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+	for len(queue.pending) == 0 {
+		queue.cond.Wait()
+	}
+	event := queue.pending[0]
+	queue.pending[0] = nil
+	queue.pending = queue.pending[1:]
+	queue.space.Signal()
+	return event
+}
+
+// apply recovers from the panic of the connector so that it goes on with the next block
+func (queue *connectorQueue) apply(event BlockEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	if revert, ok := event.(*revertEvent); ok {
+		queue.connector.Revert(revert.BlockEvent)
+	} else {
+		queue.connector.Apply(event)
+	}
+	return nil
+}
+
+func (queue *connectorQueue) setCapacity(capacity int) {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+	queue.capacity = capacity
+	queue.space.Broadcast()
+}
+
+func (queue *connectorQueue) setOverflow(overflow string) {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+	queue.overflow = overflow
+	queue.space.Broadcast()
+}
+
+func (queue *connectorQueue) run(update func()) {
+	for {
+		event := queue.pop()
+		err := queue.apply(event)
+		queue.mux.Lock()
+		if err != nil {
+			queue.errors++
+			queue.lastError = err.Error()
+			log.Printf("Error connector %s at block #%s: %v", queue.name, event.Number().String(), err)
+		} else if _, ok := event.(*revertEvent); ok {
+			queue.current = new(big.Int).Sub(event.Number(), one)
+		} else {
+			queue.current = event.Number()
+		}
+		queue.mux.Unlock()
+		update()
+	}
+}
+
+func (queue *connectorQueue) status(head *big.Int) *connectorStatus {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+	status := &connectorStatus{Queued: len(queue.pending), Capacity: queue.capacity, Dropped: queue.dropped, Errors: queue.errors, LastError: queue.lastError}
+	if queue.current != nil {
+		status.Block = queue.current.String()
+		status.Lag = "0"
+		if head != nil && head.Cmp(queue.current) > 0 {
+			status.Lag = new(big.Int).Sub(head, queue.current).String()
+		}
+	}
+	return status
+}
@@ -0,0 +1,105 @@
+package ingest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Gap is a block that still failed to be processed after its retries, not counted by the connectors
+type Gap struct {
+	Block    string `json:"block"`
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+	number   *big.Int
+}
+
+// DeadLetters keeps the gaps in a file, to be reprocessed after a restart
+type DeadLetters struct {
+	mux  sync.Mutex
+	path string
+	gaps []*Gap
+}
+
+// NewDeadLetters restores the gaps of the file, kept in memory only if the path is empty
+func NewDeadLetters(path string) (*DeadLetters, error) {
+	letters := &DeadLetters{path: path, gaps: make([]*Gap, 0)}
+	if len(path) == 0 {
+		return letters, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &letters.gaps); err != nil {
+			return nil, err
+		}
+		for _, gap := range letters.gaps {
+			gap.number, _ = new(big.Int).SetString(gap.Block, 10)
+		}
+		log.Printf("Dead letters restored with %d gaps", len(letters.gaps))
+	}
+	return letters, nil
+}
+
+// save writes the gaps in a temporary file renamed over the previous one
+func (letters *DeadLetters) save() {
+	if len(letters.path) == 0 {
+		return
+	}
+	data, err := json.Marshal(letters.gaps)
+	if err == nil {
+		err = ioutil.WriteFile(letters.path+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(letters.path+".tmp", letters.path)
+	}
+	if err != nil {
+		log.Println("Error dead letters: ", err)
+	}
+}
+
+func (letters *DeadLetters) add(number *big.Int, err error, attempts int) {
+	letters.mux.Lock()
+	defer letters.mux.Unlock()
+	i := sort.Search(len(letters.gaps), func(i int) bool {
+		return letters.gaps[i].number.Cmp(number) >= 0
+	})
+	if i < len(letters.gaps) && letters.gaps[i].number.Cmp(number) == 0 {
+		letters.gaps[i].Error = err.Error()
+		letters.gaps[i].Attempts += attempts
+	} else {
+		letters.gaps = append(letters.gaps, nil)
+		copy(letters.gaps[i+1:], letters.gaps[i:])
+		letters.gaps[i] = &Gap{Block: number.String(), Error: err.Error(), Attempts: attempts, number: new(big.Int).Set(number)}
+	}
+	letters.save()
+}
+
+func (letters *DeadLetters) remove(number *big.Int) {
+	letters.mux.Lock()
+	defer letters.mux.Unlock()
+	for i, gap := range letters.gaps {
+		if gap.number.Cmp(number) == 0 {
+			letters.gaps = append(letters.gaps[:i], letters.gaps[i+1:]...)
+			letters.save()
+			return
+		}
+	}
+}
+
+// Gaps returns the blocks failed, in order
+func (letters *DeadLetters) Gaps() []*Gap {
+	letters.mux.Lock()
+	defer letters.mux.Unlock()
+	return append([]*Gap{}, letters.gaps...)
+}
+
+func (letters *DeadLetters) MarshalJSON() ([]byte, error) {
+	return json.Marshal(letters.Gaps())
+}
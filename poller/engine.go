@@ -1,22 +1,34 @@
 package ingest
 
 import (
+	"errors"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
 	"log"
 	"math/big"
-	"reflect"
 	"strconv"
 	"sync"
 	"time"
 )
 
+// number of attempts to process a block before adding it to the dead letters
+const maxAttempts int = 5
+
 var (
-	retry   = time.Duration(5)
-	zero    = big.NewInt(0)
-	one     = big.NewInt(1)
-	ten     = big.NewInt(10)
-	hundred = big.NewInt(100)
+	// backoff between the attempts of a block failing on a transient error, doubled at every attempt
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+	zero       = big.NewInt(0)
+	one        = big.NewInt(1)
+	ten        = big.NewInt(10)
+	hundred    = big.NewInt(100)
 )
 
+// blockError is the last error of the blocks processed, in /status
+type blockError struct {
+	Block string `json:"block"`
+	Error string `json:"error"`
+}
+
 type Engine struct {
 	start          *big.Int
 	end            *big.Int
@@ -24,32 +36,46 @@ type Engine struct {
 	syncThreadPool int
 	syncThreadSize int
 	synced         int64
+	errors         int
+	checkDepth     int64
 	mux            sync.Mutex
-	status         map[string]interface{}
+	status         *Status
+	head           *big.Int
 	Queue          chan BlockEvent
-	Connector      Connector
+	connectors     []*connectorQueue
+	queueSize      int
+	confirmation   *confirmation
+	deadLetters    *DeadLetters
+	reprocess      sync.Mutex
+	started        sync.Once
 	Processor      Processor
 	RawEngine
 }
 
 func NewEngine(syncMode string, syncThreadPool int, syncThreadSize int) *Engine {
+	deadLetters, _ := NewDeadLetters("")
 	engine := &Engine{
 		start:          big.NewInt(0),
 		end:            big.NewInt(-1),
 		syncMode:       syncMode,
 		syncThreadPool: syncThreadPool,
 		syncThreadSize: syncThreadSize,
-		status: map[string]interface{}{
-			"connected": false,
-			"sync":      "0%%",
-			"current":   zero,
-		},
-		Queue: make(chan BlockEvent),
+		status: NewStatus(map[string]interface{}{
+			"connected":  false,
+			"sync":       "0%",
+			"current":    zero,
+			"errors":     0,
+			"gaps":       deadLetters,
+			"connectors": map[string]*connectorStatus{},
+		}),
+		deadLetters: deadLetters,
+		Queue:       make(chan BlockEvent),
+		connectors:  make([]*connectorQueue, 0),
 	}
 	return engine
 }
 
-func (engine *Engine) Status() map[string]interface{} {
+func (engine *Engine) Status() *Status {
 	return engine.status
 }
 
@@ -70,64 +96,203 @@ func (engine *Engine) SetEnd(val string) {
 	engine.end, _ = new(big.Int).SetString(val, 10)
 }
 
-func (engine *Engine) SetConnector(connector Connector) {
-	engine.Connector = connector
+// SetCheckDepth syncs the last blocks before the end in order, checked for forks as the blocks received when listening
+func (engine *Engine) SetCheckDepth(depth int) {
+	engine.checkDepth = int64(depth)
+}
+
+// SetConfirmations holds the blocks back from the connectors until they are depth blocks deep, or finalized by the chain
+func (engine *Engine) SetConfirmations(depth int, finalized bool, observer Pending) error {
+	var finalizer Finalizer
+	if finalized {
+		var ok bool
+		if finalizer, ok = engine.RawEngine.(Finalizer); !ok {
+			return utils.NewError(utils.ErrConfig, errors.New("no finalized block on this chain"))
+		}
+	}
+	engine.confirmation = newConfirmation(depth, finalizer, observer)
+	engine.status.Set("pending", 0)
+	return nil
+}
+
+// SetQueueSize bounds the queues of the connectors, unbounded if 0
+func (engine *Engine) SetQueueSize(size int) {
+	engine.queueSize = size
+	for _, queue := range engine.connectors {
+		queue.setCapacity(size)
+	}
+}
+
+// SetOverflow sets what happens to the blocks of a connector whose queue is full: block (default) or drop
+func (engine *Engine) SetOverflow(name string, overflow string) error {
+	if overflow != BLOCK && overflow != DROP {
+		return utils.NewError(utils.ErrConfig, errors.New("unknown overflow "+overflow+": expecting block or drop"))
+	}
+	for _, queue := range engine.connectors {
+		if queue.name == name {
+			queue.setOverflow(overflow)
+			return nil
+		}
+	}
+	return utils.NewError(utils.ErrConfig, errors.New("unknown connector "+name))
+}
+
+// AddConnector applies the blocks to the connector from its own queue, beside the other connectors
+func (engine *Engine) AddConnector(name string, connector Connector) {
+	queue := newConnectorQueue(name, connector, engine.queueSize)
+	engine.connectors = append(engine.connectors, queue)
+	go queue.run(engine.updateConnectors)
+}
+
+func (engine *Engine) updateConnectors() {
+	engine.mux.Lock()
+	head := engine.head
+	engine.mux.Unlock()
+	connectors := make(map[string]*connectorStatus)
+	for _, queue := range engine.connectors {
+		connectors[queue.name] = queue.status(head)
+	}
+	engine.status.Set("connectors", connectors)
+}
+
+// Apply queues a block for the connectors, in the order of the blocks processed
+func (engine *Engine) Apply(event interface{}) {
+	engine.Queue <- event.(BlockEvent)
+}
+
+// Revert queues the revert of a block for the connectors, after the blocks already queued
+func (engine *Engine) Revert(event interface{}) {
+	engine.Queue <- &revertEvent{event.(BlockEvent)}
+}
+
+// SetDeadLetters keeps the blocks failing in the dead letters, listed in the gaps of /status
+func (engine *Engine) SetDeadLetters(deadLetters *DeadLetters) {
+	engine.deadLetters = deadLetters
+	engine.status.Set("gaps", deadLetters)
+}
+
+func (engine *Engine) SetReady() {
+	for _, queue := range engine.connectors {
+		queue.connector.SetReady()
+	}
 }
 
 func (engine *Engine) SetProcessor(processor Processor) {
 	engine.Processor = processor
 }
 
-func (engine *Engine) sync() {
+// process retries a block failing on a transient error with an exponential backoff, the errors being reported in
+// /status, and adds it to the dead letters after maxAttempts or on another error
+func (engine *Engine) process(number *big.Int, listening bool) BlockEvent {
+	backoff := minBackoff
+	for attempt := 1; ; attempt++ {
+		blockEvent, err := engine.Process(number, listening)
+		if err == nil {
+			return blockEvent
+		}
+		if errors.Is(err, ErrKnown) {
+			log.Printf("Block #%s already applied", number.String())
+			return nil
+		}
+		engine.mux.Lock()
+		engine.errors++
+		engine.status.Set("errors", engine.errors)
+		engine.mux.Unlock()
+		engine.status.Set("lastError", &blockError{Block: number.String(), Error: err.Error()})
+		if !errors.Is(err, utils.ErrRPC) || attempt >= maxAttempts {
+			log.Printf("Error block #%s, added to the dead letters after %d attempts: %v", number.String(), attempt, err)
+			engine.deadLetters.add(number, err, attempt)
+			return nil
+		}
+		log.Printf("Error block #%s, retrying in %v: %v", number.String(), backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Reprocess processes again the blocks of the dead letters, applied by apply or else pushed to the connectors
+// after the blocks queued, and returns the blocks still failing
+func (engine *Engine) Reprocess(apply func(BlockEvent)) []*Gap {
+	engine.reprocess.Lock()
+	defer engine.reprocess.Unlock()
+	for _, gap := range engine.deadLetters.Gaps() {
+		log.Printf("Reprocess block #%s", gap.Block)
+		blockEvent := engine.process(gap.number, false)
+		if blockEvent == nil {
+			continue
+		}
+		engine.deadLetters.remove(gap.number)
+		if apply != nil {
+			apply(blockEvent)
+		} else {
+			for _, queue := range engine.connectors {
+				queue.push(blockEvent)
+			}
+		}
+	}
+	return engine.deadLetters.Gaps()
+}
+
+func (engine *Engine) sync() error {
 	log.Printf("Syncing to block #%s", engine.end.String())
 	if engine.end.Cmp(zero) == 0 {
 		engine.synced = 100
-		engine.status["sync"] = strconv.FormatInt(engine.synced, 10) + "%%"
+		engine.status.Set("sync", strconv.FormatInt(engine.synced, 10)+"%")
 		log.Printf("Synced %d", engine.synced)
 	}
+	checked := new(big.Int).Sub(engine.end, big.NewInt(engine.checkDepth-1))
+	if checked.Cmp(engine.start) < 0 {
+		checked = engine.start
+	}
 	if engine.syncMode == "normal" {
-		engine.normalSync()
+		engine.normalSync(engine.start, engine.end, checked)
 	} else if engine.syncMode == "fast" {
-		engine.fastSync()
+		engine.fastSync(engine.start, new(big.Int).Sub(checked, one))
+		engine.normalSync(checked, engine.end, checked)
 	} else {
-		log.Fatal("Unknown sync mode %s", engine.syncMode)
+		return utils.NewError(utils.ErrConfig, errors.New("unknown sync mode "+engine.syncMode))
 	}
+	return nil
 }
 
-func (engine *Engine) normalSync() {
-	for i := new(big.Int).Set(engine.start); i.Cmp(engine.end) < 0 || i.Cmp(engine.end) == 0; i.Add(i, one) {
-		blockEvent := engine.Process(i, false)
+// normalSync processes the blocks in order, the blocks from checked being checked for forks
+func (engine *Engine) normalSync(start *big.Int, end *big.Int, checked *big.Int) {
+	for i := new(big.Int).Set(start); i.Cmp(end) < 0 || i.Cmp(end) == 0; i.Add(i, one) {
+		blockEvent := engine.process(i, i.Cmp(checked) >= 0)
 		if blockEvent != nil {
 			engine.Queue <- blockEvent
 		}
-		current := new(big.Int).Add(engine.start, i)
-		if new(big.Int).Mod(current, ten).Cmp(zero) == 0 && current.Cmp(engine.end) != 0 {
+		current := new(big.Int).Add(start, i)
+		if new(big.Int).Mod(current, ten).Cmp(zero) == 0 && current.Cmp(end) != 0 {
 			engine.printSync(current)
 		}
 	}
-	engine.printSync(engine.end)
+	engine.printSync(end)
 }
 
-func (engine *Engine) fastSync() {
-	size := new(big.Int).Sub(engine.end, engine.start)
-	if size.Cmp(zero) > 0 {
+// fastSync processes the blocks from start to end (included) in parallel
+func (engine *Engine) fastSync(start *big.Int, end *big.Int) {
+	size := new(big.Int).Sub(end, start)
+	if size.Cmp(zero) >= 0 {
 		blockRange := big.NewInt(int64(engine.syncThreadPool * engine.syncThreadSize))
 		iterMax := new(big.Int).Div(size, blockRange)
 		for iter := big.NewInt(0); iter.Cmp(iterMax) < 0 || iter.Cmp(iterMax) == 0; iter.Add(iter, one) {
-			begin := new(big.Int).Add(engine.start, new(big.Int).Mul(iter, blockRange))
+			begin := new(big.Int).Add(start, new(big.Int).Mul(iter, blockRange))
 			var wg sync.WaitGroup
 			for k := 0; k < engine.syncThreadPool; k++ {
 				threadBegin := new(big.Int).Add(begin, big.NewInt(int64(k*engine.syncThreadSize)))
-				if threadBegin.Cmp(engine.end) <= 0 {
+				if threadBegin.Cmp(end) <= 0 {
 					wg.Add(1)
 					go func(threadBegin *big.Int) {
 						defer wg.Done()
 						for j := 0; j < engine.syncThreadSize; j++ {
 							i := new(big.Int).Add(threadBegin, big.NewInt(int64(j)))
-							if i.Cmp(engine.end) > 0 {
+							if i.Cmp(end) > 0 {
 								break
 							}
-							blockEvent := engine.Process(i, false)
+							blockEvent := engine.process(i, false)
 							if blockEvent != nil {
 								engine.Queue <- blockEvent
 							}
@@ -150,50 +315,92 @@ func (engine *Engine) printSync(current *big.Int) {
 	if engine.synced > 100 {
 		engine.synced = 100
 	}
-	engine.mux.Lock()
-	engine.status["sync"] = strconv.FormatInt(engine.synced, 10) + "%%"
-	engine.mux.Unlock()
+	engine.status.Set("sync", strconv.FormatInt(engine.synced, 10)+"%")
 	log.Printf("Synced %d%%", engine.synced)
 }
 
+// SetConnected reports the connection of the listener in /status
+func (engine *Engine) SetConnected(connected bool) {
+	engine.status.Set("connected", connected)
+}
+
 func (engine *Engine) initialize() {
-	if engine.status["connected"] == false {
-		engine.status["connected"] = true
+	engine.SetConnected(true)
+	engine.started.Do(func() {
 		go func() {
 			for {
 				select {
 				case blockEvent := <-engine.Queue:
-					if engine.Connector != nil && !reflect.ValueOf(engine.Connector).IsNil() {
-						engine.Connector.Apply(blockEvent)
+					events := []BlockEvent{blockEvent}
+					if engine.confirmation != nil {
+						events = engine.confirmation.push(blockEvent)
+						engine.status.Set("pending", engine.confirmation.size())
+					}
+					for _, event := range events {
+						for _, queue := range engine.connectors {
+							queue.push(event)
+						}
 					}
 					engine.mux.Lock()
-					engine.status["current"] = blockEvent.Number().String()
-					engine.mux.Unlock()
+					if _, ok := blockEvent.(*revertEvent); ok {
+						engine.head = new(big.Int).Sub(blockEvent.Number(), one)
+						engine.mux.Unlock()
+					} else {
+						engine.head = blockEvent.Number()
+						engine.mux.Unlock()
+						engine.status.Set("current", blockEvent.Number().String())
+					}
+					engine.updateConnectors()
 				}
 			}
 		}()
-	}
+	})
 }
 
-func (engine *Engine) Init() {
+func (engine *Engine) Init() error {
 	engine.initialize()
 	last, err := engine.Latest()
 	if err != nil {
-		log.Fatal(err)
+		return utils.NewError(utils.ErrRPC, err)
 	}
 	if engine.end.Cmp(zero) <= 0 {
 		engine.end = last
 	}
-	engine.sync()
+	if err = engine.sync(); err != nil {
+		return err
+	}
 	engine.end = new(big.Int).Add(last, one)
+	return nil
 }
 
 func (engine *Engine) ListenProcess(number *big.Int) {
-	for i := new(big.Int).Set(engine.end); i.Cmp(number) < 0 || i.Cmp(number) == 0; i.Add(i, one) {
-		blockEvent := engine.Process(i, true)
+	from := engine.end
+	if number.Cmp(engine.end) < 0 {
+		// a new head below the blocks already processed replaces them
+		from = number
+	}
+	for i := new(big.Int).Set(from); i.Cmp(number) < 0 || i.Cmp(number) == 0; i.Add(i, one) {
+		blockEvent := engine.process(i, true)
 		if blockEvent != nil {
 			engine.Queue <- blockEvent
 		}
 	}
 	engine.end = new(big.Int).Add(number, one)
 }
+
+// CatchUp processes the blocks up to number missed while not listening, if any
+func (engine *Engine) CatchUp(number *big.Int) {
+	if number.Cmp(engine.end) >= 0 {
+		engine.ListenProcess(number)
+	}
+}
+
+// Replay processes a range of past blocks outside of the queue, for instance to backfill a new event
+func (engine *Engine) Replay(from *big.Int, to *big.Int, apply func(BlockEvent)) {
+	for i := new(big.Int).Set(from); i.Cmp(to) <= 0; i.Add(i, one) {
+		blockEvent := engine.process(new(big.Int).Set(i), false)
+		if blockEvent != nil {
+			apply(blockEvent)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeout of a health check
+const checkTimeout = 10 * time.Second
+
+// endpoint is a node of the eth engine, in /status
+type endpoint struct {
+	URL       string `json:"url"`
+	Active    bool   `json:"active"`
+	Healthy   bool   `json:"healthy"`
+	Head      string `json:"head,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+	client    *ethclient.Client
+	rawClient *rpc.Client
+}
+
+// endpoints fails over from the node in use to the next healthy node
+type endpoints struct {
+	mux    sync.Mutex
+	list   []*endpoint
+	active int
+	next   int
+}
+
+func newEndpoints(urls string) *endpoints {
+	endpoints := &endpoints{list: make([]*endpoint, 0)}
+	for _, url := range strings.Split(urls, ",") {
+		if url = strings.TrimSpace(url); len(url) > 0 {
+			endpoints.list = append(endpoints.list, &endpoint{URL: url})
+		}
+	}
+	if len(endpoints.list) == 0 {
+		endpoints.list = append(endpoints.list, &endpoint{URL: urls})
+	}
+	return endpoints
+}
+
+// dial connects the nodes not connected yet, and returns false if none is connected
+func (endpoints *endpoints) dial() bool {
+	endpoints.mux.Lock()
+	defer endpoints.mux.Unlock()
+	connected := false
+	for _, node := range endpoints.list {
+		if node.client == nil {
+			rawClient, err := rpc.DialContext(context.Background(), node.URL)
+			if err != nil {
+				node.LastError = err.Error()
+				continue
+			}
+			node.client = ethclient.NewClient(rawClient)
+			node.rawClient = rawClient
+			node.Healthy = true
+		}
+		connected = true
+	}
+	if connected && endpoints.list[endpoints.active].client == nil {
+		endpoints.failover()
+	}
+	endpoints.list[endpoints.active].Active = true
+	return connected
+}
+
+// current returns the node in use
+func (endpoints *endpoints) current() *endpoint {
+	endpoints.mux.Lock()
+	defer endpoints.mux.Unlock()
+	return endpoints.list[endpoints.active]
+}
+
+// pick returns the healthy nodes in turn, to spread the sync of the past blocks
+func (endpoints *endpoints) pick() *endpoint {
+	endpoints.mux.Lock()
+	defer endpoints.mux.Unlock()
+	for i := 0; i < len(endpoints.list); i++ {
+		node := endpoints.list[(endpoints.next+i)%len(endpoints.list)]
+		if node.Healthy && node.client != nil {
+			endpoints.next = (endpoints.next + i + 1) % len(endpoints.list)
+			return node
+		}
+	}
+	return endpoints.list[endpoints.active]
+}
+
+// others returns the healthy nodes besides the node
+func (endpoints *endpoints) others(node *endpoint) []*endpoint {
+	endpoints.mux.Lock()
+	defer endpoints.mux.Unlock()
+	others := make([]*endpoint, 0, len(endpoints.list))
+	for _, other := range endpoints.list {
+		if other != node && other.Healthy && other.client != nil {
+			others = append(others, other)
+		}
+	}
+	return others
+}
+
+// answered tells an error given by the node, such as a block it does not have yet while lagging, from an error of
+// the transport to the node
+func answered(err error) bool {
+	var rpcErr rpc.Error
+	return err == ethereum.NotFound || errors.As(err, &rpcErr)
+}
+
+// fail marks the node unhealthy after an error of the transport and fails over if it is in use
+func (endpoints *endpoints) fail(node *endpoint, err error) {
+	endpoints.mux.Lock()
+	defer endpoints.mux.Unlock()
+	node.LastError = err.Error()
+	if answered(err) {
+		return
+	}
+	node.Healthy = false
+	if endpoints.list[endpoints.active] == node {
+		endpoints.failover()
+	}
+}
+
+// failover switches to the next healthy node, if any
+func (endpoints *endpoints) failover() {
+	for i := 1; i < len(endpoints.list); i++ {
+		j := (endpoints.active + i) % len(endpoints.list)
+		if node := endpoints.list[j]; node.Healthy && node.client != nil {
+			log.Printf("Failover from %s to %s", endpoints.list[endpoints.active].URL, node.URL)
+			endpoints.list[endpoints.active].Active = false
+			endpoints.active = j
+			node.Active = true
+			return
+		}
+	}
+}
+
+// check updates the health of the nodes from their latest block and fails over if the node in use is down
+func (endpoints *endpoints) check() {
+	endpoints.dial()
+	endpoints.mux.Lock()
+	clients := make(map[*endpoint]*ethclient.Client)
+	for _, node := range endpoints.list {
+		if node.client != nil {
+			clients[node] = node.client
+		}
+	}
+	endpoints.mux.Unlock()
+	for node, client := range clients {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		header, err := client.HeaderByNumber(ctx, nil)
+		cancel()
+		endpoints.mux.Lock()
+		if err != nil {
+			node.Healthy = answered(err)
+			node.LastError = err.Error()
+		} else {
+			node.Healthy = true
+			node.Head = header.Number.String()
+		}
+		endpoints.mux.Unlock()
+	}
+	endpoints.mux.Lock()
+	if !endpoints.list[endpoints.active].Healthy {
+		endpoints.failover()
+	}
+	endpoints.mux.Unlock()
+}
+
+func (endpoints *endpoints) MarshalJSON() ([]byte, error) {
+	endpoints.mux.Lock()
+	defer endpoints.mux.Unlock()
+	return json.Marshal(endpoints.list)
+}
@@ -2,94 +2,352 @@ package engine
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	poller "github.com/IRT-SystemX/bcm-poller/poller"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
-	"github.com/ethereum/go-ethereum/rpc"
 	"log"
 	"math/big"
 	"reflect"
+	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	retry = time.Duration(5)
+	// backoff between the subscriptions to the new heads, doubled at every failure
+	minReconnect = time.Second
+	maxReconnect = time.Minute
+	// bounds of the interval between two polls
+	minPoll = 500 * time.Millisecond
+	maxPoll = time.Minute
+	// re-checks of the nodes lagging behind a new block before failing its quorum
+	agreeRetries = 3
+	agreeDelay   = time.Second
+)
+
+// listen modes of the eth engine
+const (
+	SUBSCRIBE = "subscribe"
+	POLL      = "poll"
+	// polls the nodes of an http url and subscribes to the others
+	AUTO = "auto"
 )
 
 type rpcBlockHash struct {
 	Hash common.Hash `json:"hash"`
 }
 
+type rpcBlockNumber struct {
+	Number *hexutil.Big `json:"number"`
+}
+
+// BlockTime gives the time between two blocks observed in seconds, 0 if not known yet
+type BlockTime interface {
+	BlockTime() uint64
+}
+
+// nodeBlock is a block with the node it was fetched from, for the processor to fetch the rest of the block from it
+type nodeBlock struct {
+	block *types.Block
+	node  *endpoint
+}
+
+func (nodeBlock *nodeBlock) Block() *types.Block {
+	return nodeBlock.block
+}
+
+func (nodeBlock *nodeBlock) Client() *ethclient.Client {
+	return nodeBlock.node.client
+}
+
+// blockDisagreement is the last block on which the nodes disagreed, in /status
+type blockDisagreement struct {
+	Block  string            `json:"block"`
+	Hashes map[string]string `json:"hashes"`
+}
+
 type EthEngine struct {
 	*poller.Engine
-	url       string
-	client    *ethclient.Client
-	rawClient *rpc.Client
+	endpoints     *endpoints
+	roundRobin    bool
+	quorum        int
+	disagreements int
+	mux           sync.Mutex
+	mode          string
+	interval      time.Duration
+	blockTime     BlockTime
 }
 
+// NewEthEngine connects to the node of the url, or fails over between the nodes of the urls separated by commas
 func NewEthEngine(web3Socket string, syncMode string, syncThreadPool int, syncThreadSize int) *poller.Engine {
 	engine := &EthEngine{
-		Engine: poller.NewEngine(syncMode, syncThreadPool, syncThreadSize),
-		url:    web3Socket,
+		Engine:    poller.NewEngine(syncMode, syncThreadPool, syncThreadSize),
+		endpoints: newEndpoints(web3Socket),
 	}
 	engine.Engine.RawEngine = engine
 	return engine.Engine
 }
 
 func (engine *EthEngine) Connect() *ethclient.Client {
-	for {
-		rawClient, err := rpc.DialContext(context.Background(), engine.url)
-		if err != nil {
-			time.Sleep(retry * time.Second)
-		} else {
-			engine.client = ethclient.NewClient(rawClient)
-			engine.rawClient = rawClient
-			break
+	for !engine.endpoints.dial() {
+		time.Sleep(retry * time.Second)
+	}
+	engine.Status().Set("endpoints", engine.endpoints)
+	return engine.Client()
+}
+
+// Client returns the client of the node in use, which changes on a failover
+func (engine *EthEngine) Client() *ethclient.Client {
+	return engine.endpoints.current().client
+}
+
+// SetHealthCheck checks the latest block of every node at every interval, failing over if the node in use is down
+func (engine *EthEngine) SetHealthCheck(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			engine.endpoints.check()
 		}
+	}()
+}
+
+// SetRoundRobin fetches the past blocks from the healthy nodes in turn
+func (engine *EthEngine) SetRoundRobin(roundRobin bool) {
+	engine.roundRobin = roundRobin
+}
+
+// SetQuorum processes a new block once the number of nodes given the same hash, raising an alert when a node gives
+// another hash
+func (engine *EthEngine) SetQuorum(quorum int) error {
+	if quorum <= 0 || quorum > len(engine.endpoints.list) {
+		return utils.NewError(utils.ErrConfig, fmt.Errorf("quorum %d out of the %d nodes", quorum, len(engine.endpoints.list)))
 	}
-	return engine.client
+	engine.quorum = quorum
+	engine.Status().Set("disagreements", 0)
+	return nil
 }
 
 func (engine *EthEngine) Latest() (*big.Int, error) {
-	header, err := engine.client.HeaderByNumber(context.Background(), nil)
+	node := engine.endpoints.current()
+	header, err := node.client.HeaderByNumber(context.Background(), nil)
 	if err != nil {
+		engine.endpoints.fail(node, err)
 		return nil, err
 	} else {
 		return header.Number, nil
 	}
 }
 
-func (engine *EthEngine) Process(number *big.Int, listening bool) poller.BlockEvent {
-	block, err := engine.client.BlockByNumber(context.Background(), number)
+func (engine *EthEngine) Hash(number *big.Int) (string, error) {
+	return engine.hash(engine.endpoints.current(), number)
+}
+
+func (engine *EthEngine) hash(node *endpoint, number *big.Int) (string, error) {
+	var head *rpcBlockHash
+	err := node.rawClient.CallContext(context.Background(), &head, "eth_getBlockByNumber", hexutil.EncodeBig(number), false)
 	if err != nil {
-		log.Println("Error block: ", err)
-		return nil
+		engine.endpoints.fail(node, err)
+		return "", err
+	}
+	if head == nil {
+		return "", errors.New("Unknown block #" + number.String())
 	}
-	var head rpcBlockHash
-	err = engine.rawClient.CallContext(context.Background(), &head, "eth_getBlockByNumber", hexutil.EncodeBig(number), false)
+	return head.Hash.Hex(), nil
+}
+
+// Finalized returns the number of the block tagged finalized by the node, on the chains with a finality
+func (engine *EthEngine) Finalized() (*big.Int, error) {
+	node := engine.endpoints.current()
+	var head *rpcBlockNumber
+	err := node.rawClient.CallContext(context.Background(), &head, "eth_getBlockByNumber", "finalized", false)
 	if err != nil {
-		log.Println("Error block hash: ", err)
+		engine.endpoints.fail(node, err)
+		return nil, err
 	}
-	log.Printf("Process block #%s (%s) %s", block.Number().String(), time.Unix(int64(block.Time()), 0).Format("2006.01.02 15:04:05"), head.Hash.Hex())
-	event := engine.Processor.NewBlockEvent(block.Number(), block.ParentHash().Hex(), head.Hash.Hex())
-	if engine.Processor != nil && !reflect.ValueOf(engine.Processor).IsNil() {
-		engine.Processor.Process(block, event, listening)
+	if head == nil || head.Number == nil {
+		return nil, errors.New("No finalized block")
+	}
+	return head.Number.ToInt(), nil
+}
+
+// agree checks that the quorum of nodes, the node of the block included, give the hash of the block, re-checking the
+// nodes which do not have the block yet until the quorum is reached
+func (engine *EthEngine) agree(node *endpoint, number *big.Int, hash string) error {
+	agreed := 1
+	hashes := map[string]string{node.URL: hash}
+	lagging := engine.endpoints.others(node)
+	for attempt := 0; len(lagging) > 0 && (attempt == 0 || agreed < engine.quorum && attempt <= agreeRetries); attempt++ {
+		if attempt > 0 {
+			time.Sleep(agreeDelay)
+		}
+		pending := make([]*endpoint, 0, len(lagging))
+		for _, other := range lagging {
+			var head *rpcBlockHash
+			err := other.rawClient.CallContext(context.Background(), &head, "eth_getBlockByNumber", hexutil.EncodeBig(number), false)
+			if err != nil {
+				engine.endpoints.fail(other, err)
+				if answered(err) {
+					pending = append(pending, other)
+				}
+				continue
+			}
+			if head == nil {
+				pending = append(pending, other)
+				continue
+			}
+			hashes[other.URL] = head.Hash.Hex()
+			if head.Hash.Hex() == hash {
+				agreed++
+			}
+		}
+		lagging = pending
+	}
+	if agreed < len(hashes) {
+		log.Printf("Alert: nodes disagree on block #%s: %v", number.String(), hashes)
+		engine.mux.Lock()
+		engine.disagreements++
+		engine.Status().Set("disagreements", engine.disagreements)
+		engine.mux.Unlock()
+		engine.Status().Set("lastDisagreement", &blockDisagreement{Block: number.String(), Hashes: hashes})
+	}
+	if agreed < engine.quorum {
+		return fmt.Errorf("block #%s %s given by %d nodes out of a quorum of %d", number.String(), hash, agreed, engine.quorum)
 	}
-	return event
+	return nil
 }
 
-func (engine *EthEngine) Listen() {
-	headers := make(chan *types.Header)
-	sub, err := engine.client.SubscribeNewHead(context.Background(), headers)
+func (engine *EthEngine) Process(number *big.Int, listening bool) (poller.BlockEvent, error) {
+	node := engine.endpoints.current()
+	if engine.roundRobin && !listening {
+		node = engine.endpoints.pick()
+	}
+	block, err := node.client.BlockByNumber(context.Background(), number)
+	if err != nil {
+		engine.endpoints.fail(node, err)
+		return nil, utils.NewError(utils.ErrRPC, err)
+	}
+	hash, err := engine.hash(node, number)
 	if err != nil {
-		log.Fatal(err)
+		return nil, utils.NewError(utils.ErrRPC, err)
+	}
+	if listening && engine.quorum > 0 {
+		if err = engine.agree(node, number, hash); err != nil {
+			return nil, utils.NewError(utils.ErrRPC, err)
+		}
+	}
+	log.Printf("Process block #%s (%s) %s", block.Number().String(), time.Unix(int64(block.Time()), 0).Format("2006.01.02 15:04:05"), hash)
+	event := engine.Processor.NewBlockEvent(block.Number(), block.ParentHash().Hex(), hash)
+	if engine.Processor != nil && !reflect.ValueOf(engine.Processor).IsNil() {
+		if err = engine.Processor.Process(&nodeBlock{block: block, node: node}, event, listening); err != nil {
+			return nil, err
+		}
+	}
+	return event, nil
+}
+
+// SetListenMode polls the latest block instead of subscribing to the new heads, from every node or with AUTO from the
+// nodes of an http url, every interval until the block time is observed and then twice per block
+func (engine *EthEngine) SetListenMode(mode string, interval time.Duration, blockTime BlockTime) error {
+	if mode != SUBSCRIBE && mode != POLL && mode != AUTO {
+		return utils.NewError(utils.ErrConfig, errors.New("unknown listen mode "+mode))
+	}
+	engine.mode = mode
+	engine.interval = interval
+	engine.blockTime = blockTime
+	return nil
+}
+
+func (engine *EthEngine) polled(node *endpoint) bool {
+	return engine.mode == POLL || engine.mode == AUTO && (strings.HasPrefix(node.URL, "http://") || strings.HasPrefix(node.URL, "https://"))
+}
+
+func (engine *EthEngine) pollInterval() time.Duration {
+	interval := engine.interval
+	if engine.blockTime != nil {
+		if seconds := engine.blockTime.BlockTime(); seconds > 0 {
+			interval = time.Duration(seconds) * time.Second / 2
+		}
 	}
+	if interval < minPoll {
+		return minPoll
+	}
+	if interval > maxPoll {
+		return maxPoll
+	}
+	return interval
+}
+
+// poll processes the blocks up to the latest one at every interval, until a failover to a node to subscribe to
+func (engine *EthEngine) poll() {
+	log.Printf("Polling %s", engine.endpoints.current().URL)
+	for engine.polled(engine.endpoints.current()) {
+		time.Sleep(engine.pollInterval())
+		last, err := engine.Latest()
+		if err != nil {
+			engine.SetConnected(false)
+			log.Println("Error poll: ", err)
+			continue
+		}
+		engine.SetConnected(true)
+		engine.CatchUp(last)
+	}
+}
+
+// Listen subscribes to the new heads, or polls them, and when the subscription drops, resubscribes with a backoff
+// and catches up the blocks missed meanwhile
+func (engine *EthEngine) Listen() error {
+	backoff := minReconnect
+	reconnects := 0
+	for {
+		node := engine.endpoints.current()
+		if engine.polled(node) {
+			engine.poll()
+			continue
+		}
+		headers := make(chan *types.Header)
+		sub, err := node.client.SubscribeNewHead(context.Background(), headers)
+		if err != nil {
+			engine.endpoints.fail(node, err)
+			engine.SetConnected(false)
+			log.Printf("Error subscription, retrying in %v: %v", backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxReconnect {
+				backoff = maxReconnect
+			}
+			continue
+		}
+		backoff = minReconnect
+		engine.SetConnected(true)
+		if reconnects > 0 {
+			last, err := engine.Latest()
+			if err != nil {
+				log.Println("Error catch up: ", err)
+			} else {
+				log.Printf("Resubscribed, catching up to block #%s", last.String())
+				engine.CatchUp(last)
+			}
+		}
+		err = engine.receive(sub, headers)
+		sub.Unsubscribe()
+		engine.SetConnected(false)
+		reconnects++
+		engine.Status().Set("reconnects", reconnects)
+		log.Println("Error subscription dropped: ", err)
+	}
+}
+
+// receive processes the new heads until the subscription fails
+func (engine *EthEngine) receive(sub ethereum.Subscription, headers chan *types.Header) error {
 	for {
 		select {
 		case err := <-sub.Err():
-			log.Println("Error: ", err)
+			return err
 		case header := <-headers:
 			//log.Printf("New block #%s", header.Number.String())
 			if header != nil {
@@ -1,10 +1,13 @@
 package engine
 
 import (
+	"crypto/sha256"
+	"encoding/asn1"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	poller "github.com/IRT-SystemX/bcm-poller/poller"
+	utils "github.com/IRT-SystemX/bcm-poller/utils"
 	"github.com/hyperledger/fabric-sdk-go/pkg/client/ledger"
 	"github.com/hyperledger/fabric-sdk-go/pkg/core/config"
 	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
@@ -17,6 +20,22 @@ import (
 	"time"
 )
 
+type asn1Header struct {
+	Number       *big.Int
+	PreviousHash []byte
+	DataHash     []byte
+}
+
+// headerHash is the hash of the block referenced by the PreviousHash of the next block
+func headerHash(number uint64, previousHash []byte, dataHash []byte) (string, error) {
+	raw, err := asn1.Marshal(asn1Header{Number: new(big.Int).SetUint64(number), PreviousHash: previousHash, DataHash: dataHash})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(raw)
+	return hex.EncodeToString(hash[:]), nil
+}
+
 type HlfEngine struct {
 	*poller.Engine
 	path       string
@@ -42,12 +61,12 @@ func loadProfile(pathFile string) (map[string]interface{}, error) {
 	if err == nil {
 		data, err := ioutil.ReadFile(pathFile)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		raw := make(map[string]interface{})
 		err = json.Unmarshal([]byte(data), &raw)
 		if err != nil {
-			log.Fatalf("error: %v", err)
+			return nil, err
 		}
 		return raw, nil
 	} else {
@@ -95,52 +114,52 @@ func getOrgName(raw map[string]interface{}) (string, error) {
 	return client["organization"].(string), nil
 }
 
-func (engine *HlfEngine) Connect() {
+func (engine *HlfEngine) Connect() error {
 	profile, err := loadProfile(engine.path)
 	if err != nil {
-		log.Fatal(err)
+		return utils.NewError(utils.ErrConfig, err)
 	}
 	channelName, err := getChannelName(profile)
 	if err != nil {
-		log.Fatal(err)
+		return utils.NewError(utils.ErrConfig, err)
 	}
 	configFile := config.FromFile(engine.path)
 	// create client
 	sdk, err := fabsdk.New(configFile)
 	if err != nil {
-		log.Fatal(err)
+		return utils.NewError(utils.ErrConfig, err)
 	}
 	orgName, err := getOrgName(profile)
 	if err != nil {
-		log.Fatal(err)
+		return utils.NewError(utils.ErrConfig, err)
 	}
 	contextOrg := fabsdk.WithOrg(orgName)
 	contextUser := fabsdk.WithUser(engine.orgUser)
 	client, err := ledger.New(sdk.ChannelContext(channelName, contextUser, contextOrg))
 	if err != nil {
-		log.Fatal(err)
+		return utils.NewError(utils.ErrRPC, err)
 	}
 	engine.client = client
 	log.Printf("ledger ok")
 	// create network
 	walletPath, err := getWalletPath(profile)
 	if err != nil {
-		log.Fatal(err)
+		return utils.NewError(utils.ErrConfig, err)
 	}
 	wallet, err := gateway.NewFileSystemWallet(walletPath)
 	if err != nil {
-		log.Fatal(err)
+		return utils.NewError(utils.ErrConfig, err)
 	}
 	_, err = wallet.Get(engine.walletUser)
 	if err != nil {
-		log.Fatal(err)
+		return utils.NewError(utils.ErrConfig, err)
 	}
 	gw, err := gateway.Connect(
 		gateway.WithConfig(configFile),
 		gateway.WithIdentity(wallet, engine.walletUser),
 	)
 	if err != nil {
-		log.Fatal(err)
+		return utils.NewError(utils.ErrRPC, err)
 	}
 	log.Printf("gateway ok")
 	for {
@@ -150,7 +169,7 @@ func (engine *HlfEngine) Connect() {
 		} else {
 			log.Printf("network ok")
 			engine.network = network
-			break
+			return nil
 		}
 	}
 }
@@ -164,24 +183,37 @@ func (engine *HlfEngine) Latest() (*big.Int, error) {
 	}
 }
 
-func (engine *HlfEngine) Process(number *big.Int, listening bool) poller.BlockEvent {
+func (engine *HlfEngine) Hash(number *big.Int) (string, error) {
+	block, err := engine.client.QueryBlock(number.Uint64())
+	if err != nil {
+		return "", err
+	}
+	return headerHash(block.Header.Number, block.Header.PreviousHash, block.Header.DataHash)
+}
+
+func (engine *HlfEngine) Process(number *big.Int, listening bool) (poller.BlockEvent, error) {
 	block, err := engine.client.QueryBlock(number.Uint64())
 	if err != nil {
-		log.Println("Error block: ", err)
-		return nil
+		return nil, utils.NewError(utils.ErrRPC, err)
 	}
 	log.Printf("Process block %d", block.Header.Number)
-	event := engine.Processor.NewBlockEvent(big.NewInt(int64(block.Header.Number)), hex.EncodeToString(block.Header.PreviousHash), hex.EncodeToString(block.Header.DataHash))
+	hash, err := headerHash(block.Header.Number, block.Header.PreviousHash, block.Header.DataHash)
+	if err != nil {
+		return nil, utils.NewError(utils.ErrDecode, err)
+	}
+	event := engine.Processor.NewBlockEvent(big.NewInt(int64(block.Header.Number)), hex.EncodeToString(block.Header.PreviousHash), hash)
 	if engine.Processor != nil && !reflect.ValueOf(engine.Processor).IsNil() {
-		engine.Processor.Process(block, event, listening)
+		if err = engine.Processor.Process(block, event, listening); err != nil {
+			return nil, err
+		}
 	}
-	return event
+	return event, nil
 }
 
-func (engine *HlfEngine) Listen() {
+func (engine *HlfEngine) Listen() error {
 	reg, notifier, err := engine.network.RegisterFilteredBlockEvent()
 	if err != nil {
-		log.Fatalln("Failed to register filtered block event: %s", err)
+		return utils.NewError(utils.ErrRPC, err)
 	}
 	defer engine.network.Unregister(reg)
 	for {
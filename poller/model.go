@@ -1,17 +1,21 @@
 package ingest
 
 import (
+	"errors"
 	"math/big"
 )
 
+// ErrKnown is returned by the processors for a block processed again with the hash already applied, skipped
+var ErrKnown = errors.New("block already applied")
+
 type BlockEvent interface {
 	Number() *big.Int
 }
 
 type RawEngine interface {
 	Latest() (*big.Int, error)
-	Process(number *big.Int, listening bool) BlockEvent
-	Listen()
+	Process(number *big.Int, listening bool) (BlockEvent, error)
+	Listen() error
 }
 
 type Connector interface {
@@ -22,5 +26,15 @@ type Connector interface {
 
 type Processor interface {
 	NewBlockEvent(*big.Int, string, string) BlockEvent
-	Process(interface{}, BlockEvent, bool)
+	Process(interface{}, BlockEvent, bool) error
+}
+
+// Finalizer is implemented by the engines of the chains tagging their finalized block
+type Finalizer interface {
+	Finalized() (*big.Int, error)
+}
+
+// Hasher is implemented by the engines giving the hash of a block of the chain
+type Hasher interface {
+	Hash(number *big.Int) (string, error)
 }
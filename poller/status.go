@@ -0,0 +1,34 @@
+package ingest
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Status holds the values of /status, updated by the engine while the server encodes them
+type Status struct {
+	mux    sync.RWMutex
+	values map[string]interface{}
+}
+
+func NewStatus(values map[string]interface{}) *Status {
+	return &Status{values: values}
+}
+
+func (status *Status) Get(key string) interface{} {
+	status.mux.RLock()
+	defer status.mux.RUnlock()
+	return status.values[key]
+}
+
+func (status *Status) Set(key string, value interface{}) {
+	status.mux.Lock()
+	defer status.mux.Unlock()
+	status.values[key] = value
+}
+
+func (status *Status) MarshalJSON() ([]byte, error) {
+	status.mux.RLock()
+	defer status.mux.RUnlock()
+	return json.Marshal(status.values)
+}
@@ -22,15 +22,15 @@ type DiskUsage struct {
 	refresh   uint64
 }
 
-func NewDiskUsage(volumePath string, refresh uint64) *DiskUsage {
+func NewDiskUsage(volumePath string, refresh uint64) (*DiskUsage, error) {
 	_, err := os.Stat(volumePath)
 	if os.IsNotExist(err) {
 		err := os.MkdirAll(volumePath, os.ModePerm)
 		if err != nil {
-			log.Fatal(err)
+			return nil, NewError(ErrConfig, err)
 		}
 	}
-	return &DiskUsage{path: volumePath, refresh: refresh}
+	return &DiskUsage{path: volumePath, refresh: refresh}, nil
 }
 
 func (usage *DiskUsage) Update() {
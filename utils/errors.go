@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"errors"
+)
+
+// kinds of the errors returned by the pollers instead of exiting, checked with errors.Is
+var (
+	ErrRPC    = errors.New("rpc")
+	ErrConfig = errors.New("config")
+	ErrDecode = errors.New("decode")
+	ErrBackup = errors.New("backup")
+)
+
+// Error tags an error with its kind
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func NewError(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+func (err *Error) Error() string {
+	return err.Kind.Error() + " error: " + err.Err.Error()
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+func (err *Error) Is(target error) bool {
+	return target == err.Kind
+}
@@ -3,60 +3,114 @@ package utils
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"math/big"
 	"net/http"
+	"strings"
+	"sync"
 )
 
+// Fetcher calls the api of a host, failing over to the next hosts when it does not answer
 type Fetcher struct {
-	host string
+	mux    sync.Mutex
+	hosts  []string
+	active int
 }
 
-func NewFetcher(host string) *Fetcher {
-	_, err := http.Post(host, "application/json", bytes.NewBufferString(""))
-	if err != nil {
-		return nil
+// NewFetcher takes a host or hosts separated by commas, nil if none answers
+func NewFetcher(hosts string) *Fetcher {
+	fetcher := &Fetcher{hosts: make([]string, 0)}
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); len(host) > 0 {
+			fetcher.hosts = append(fetcher.hosts, host)
+		}
+	}
+	for i, host := range fetcher.hosts {
+		res, err := http.Post(host, "application/json", bytes.NewBufferString(""))
+		if err == nil {
+			res.Body.Close()
+			fetcher.active = i
+			return fetcher
+		}
 	}
-	return &Fetcher{host: host}
+	return nil
 }
 
-func request(host string, params map[string]interface{}) map[string]interface{} {
+func request(host string, params map[string]interface{}) (map[string]interface{}, error) {
 	buf, err := json.Marshal(params)
 	if err != nil {
-		log.Fatal(err)
+		return nil, NewError(ErrRPC, err)
 	}
 	res, err := http.Post(host, "application/json", bytes.NewBuffer(buf))
 	if err != nil {
-		log.Fatal(err)
+		return nil, NewError(ErrRPC, err)
 	}
 	defer res.Body.Close()
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Fatal(err)
+		return nil, NewError(ErrRPC, err)
 	}
 	var doc map[string]interface{}
 	err = json.Unmarshal(body, &doc)
 	if err != nil {
-		log.Fatal(err)
+		return nil, NewError(ErrDecode, err)
+	}
+	if rpcErr, ok := doc["error"]; ok && rpcErr != nil {
+		return nil, NewError(ErrRPC, fmt.Errorf("%s: %v", params["method"], rpcErr))
+	}
+	return doc, nil
+}
+
+// request calls the host in use, or else the next hosts
+func (fetcher *Fetcher) request(params map[string]interface{}) (map[string]interface{}, error) {
+	fetcher.mux.Lock()
+	active := fetcher.active
+	fetcher.mux.Unlock()
+	var err error
+	for i := 0; i < len(fetcher.hosts); i++ {
+		j := (active + i) % len(fetcher.hosts)
+		var doc map[string]interface{}
+		if doc, err = request(fetcher.hosts[j], params); err == nil {
+			if j != active {
+				log.Printf("Failover from %s to %s", fetcher.hosts[active], fetcher.hosts[j])
+				fetcher.mux.Lock()
+				fetcher.active = j
+				fetcher.mux.Unlock()
+			}
+			return doc, nil
+		}
 	}
-	return doc
+	return nil, err
 }
 
-func (fetcher *Fetcher) Get(method string) interface{} {
-	return request(fetcher.host, map[string]interface{}{
+func (fetcher *Fetcher) Get(method string) (interface{}, error) {
+	doc, err := fetcher.request(map[string]interface{}{
 		"method":  method,
 		"params":  make([]string, 0),
 		"id":      1,
 		"jsonrpc": "2.0",
-	})["result"]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return doc["result"], nil
 }
 
-func (fetcher *Fetcher) GetBalance(address string) *big.Int {
-	return Decode(request(fetcher.host, map[string]interface{}{
+func (fetcher *Fetcher) GetBalance(address string) (*big.Int, error) {
+	doc, err := fetcher.request(map[string]interface{}{
 		"method":  "eth_getBalance",
 		"params":  [1]string{address},
 		"id":      1,
 		"jsonrpc": "2.0",
-	})["result"].(string))
+	})
+	if err != nil {
+		return nil, err
+	}
+	result, ok := doc["result"].(string)
+	if !ok {
+		return nil, NewError(ErrDecode, fmt.Errorf("eth_getBalance: unexpected result %v", doc["result"]))
+	}
+	return Decode(result)
 }
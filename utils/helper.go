@@ -3,7 +3,6 @@ package utils
 import (
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
-	"log"
 	"math"
 	"math/big"
 	"strconv"
@@ -17,29 +16,33 @@ func IntToString(val int64) string {
 	return strconv.FormatInt(val, 10)
 }
 
-func StringToFloat(val string) float64 {
+func StringToFloat(val string) (float64, error) {
 	if len(val) == 0 {
-		return 0
+		return 0, nil
 	}
 	value, err := strconv.ParseFloat(val, 64)
 	if err != nil {
-		log.Fatal(err)
+		return 0, NewError(ErrDecode, err)
 	}
-	return value
+	return value, nil
 }
 
 func Percent(val float64, limit float64) string {
-	return strconv.FormatInt(int64(math.Abs(val*100/limit)), 10) + "%%"
+	return strconv.FormatInt(int64(math.Abs(val*100/limit)), 10) + "%"
 }
 
-func Decode(res string) *big.Int {
+func Decode(res string) (*big.Int, error) {
 	val, err := hexutil.DecodeBig(res)
 	if err != nil {
-		log.Fatal(err)
+		return nil, NewError(ErrDecode, err)
 	}
-	return val
+	return val, nil
 }
 
 func GetFunctionId(value string) string {
 	return crypto.Keccak256Hash([]byte(value)).Hex()[:10]
 }
+
+func GetEventId(value string) string {
+	return crypto.Keccak256Hash([]byte(value)).Hex()
+}
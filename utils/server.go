@@ -1,17 +1,102 @@
 package utils
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 )
 
+var reservedParams = map[string]bool{"offset": true, "limit": true}
+
 type handler struct {
+	path     string
 	resource interface{}
+	lock     sync.Locker
+}
+
+// marshal encodes the resource while its owner does not modify it
+func (handler *handler) marshal() ([]byte, error) {
+	if handler.lock != nil {
+		handler.lock.Lock()
+		defer handler.lock.Unlock()
+	}
+	return json.Marshal(handler.resource)
+}
+
+// document converts the encoded resource into generic maps and slices to navigate into it
+func document(jsonBytes []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.UseNumber()
+	var doc interface{}
+	err := decoder.Decode(&doc)
+	return doc, err
+}
+
+// lookup returns the field of an object or the item of a list identified by its label or id
+func lookup(doc interface{}, key string) (interface{}, bool) {
+	switch val := doc.(type) {
+	case map[string]interface{}:
+		child, ok := val[key]
+		return child, ok
+	case []interface{}:
+		for _, item := range val {
+			if obj, ok := item.(map[string]interface{}); ok && (obj["label"] == key || obj["id"] == key) {
+				return obj, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func filter(list []interface{}, params map[string][]string) []interface{} {
+	output := make([]interface{}, 0, len(list))
+	for _, item := range list {
+		obj, ok := item.(map[string]interface{})
+		match := true
+		for key, values := range params {
+			if !reservedParams[key] {
+				match = match && ok && obj[key] != nil && fmt.Sprint(obj[key]) == values[0]
+			}
+		}
+		if match {
+			output = append(output, item)
+		}
+	}
+	return output
+}
+
+func paginate(list []interface{}, params map[string][]string) ([]interface{}, error) {
+	offset, limit := 0, len(list)
+	var err error
+	if val, ok := params["offset"]; ok {
+		if offset, err = strconv.Atoi(val[0]); err != nil || offset < 0 {
+			return nil, errors.New("invalid offset " + val[0])
+		}
+	}
+	if val, ok := params["limit"]; ok {
+		if limit, err = strconv.Atoi(val[0]); err != nil || limit < 0 {
+			return nil, errors.New("invalid limit " + val[0])
+		}
+	}
+	if offset > len(list) {
+		offset = len(list)
+	}
+	if offset+limit > len(list) {
+		limit = len(list) - offset
+	}
+	return list[offset : offset+limit], nil
 }
 
 func (handler *handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
@@ -19,30 +104,86 @@ func (handler *handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	resp.Header().Set("Content-Type", "application/json")
-	jsonBytes, err := json.MarshalIndent(handler.resource, "", "\t")
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, handler.path), "/")
+	jsonBytes, err := handler.marshal()
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(path) == 0 && len(req.URL.Query()) == 0 {
+		WriteJSON(resp, req, json.RawMessage(jsonBytes))
+		return
+	}
+	doc, err := document(jsonBytes)
 	if err != nil {
-		log.Fatal(err)
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, key := range strings.Split(path, "/") {
+		if len(key) > 0 {
+			var ok bool
+			if doc, ok = lookup(doc, key); !ok {
+				http.NotFound(resp, req)
+				return
+			}
+		}
 	}
-	fmt.Fprintf(resp, string(jsonBytes)+"\n")
+	if list, ok := doc.([]interface{}); ok {
+		list = filter(list, req.URL.Query())
+		resp.Header().Set("X-Total-Count", strconv.Itoa(len(list)))
+		if doc, err = paginate(list, req.URL.Query()); err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	WriteJSON(resp, req, doc)
+}
+
+// WriteJSON sends the indented object with an ETag, or 304 if the client already has it
+func WriteJSON(resp http.ResponseWriter, req *http.Request, obj interface{}) {
+	jsonBytes, err := json.MarshalIndent(obj, "", "\t")
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hash := sha1.Sum(jsonBytes)
+	etag := "\"" + hex.EncodeToString(hash[:]) + "\""
+	resp.Header().Set("ETag", etag)
+	if match := req.Header.Get("If-None-Match"); len(match) > 0 && (match == etag || match == "*") {
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(append(jsonBytes, '\n'))
 }
 
 type server struct {
 	*http.Server
+	lock sync.Locker
 }
 
 func NewServer(port string) *server {
 	addr := "0.0.0.0:" + port
 	httpServer := http.Server{Addr: addr, Handler: http.DefaultServeMux}
-	return &server{&httpServer}
+	return &server{Server: &httpServer}
+}
+
+// SetLock guards the resources bound afterwards against concurrent updates
+func (server *server) SetLock(lock sync.Locker) {
+	server.lock = lock
 }
 
 func (server *server) Bind(resource map[string]interface{}) {
 	for key, value := range resource {
-		http.Handle("/"+key, &handler{resource: value})
+		http.Handle("/"+key, &handler{path: "/" + key, resource: value, lock: server.lock})
+		http.Handle("/"+key+"/", &handler{path: "/" + key, resource: value, lock: server.lock})
 	}
 }
 
+func (server *server) Handle(path string, handler http.Handler) {
+	http.Handle(path, handler)
+}
+
 func (server *server) Start() {
 	log.Printf("Listening on %s\n", server.Addr)
 	go func() {
@@ -50,8 +191,8 @@ func (server *server) Start() {
 			log.Panic(err)
 		}
 	}()
-	quit := make(chan os.Signal)
-	signal.Notify(quit, os.Interrupt)
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	sig := <-quit
 	log.Println("Shutting down server... Reason:", sig)
 